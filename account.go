@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+)
+
+type AccountExport struct {
+	User         string
+	NetId        string
+	Email        string
+	Admin        bool
+	CreatedAt    time.Time
+	NetIds       []NetIdInfo
+	Reservations []ReservationResult
+	// status history of the reservations
+	ReservationEvents []ReservationEvent
+	Rules             []RuleInfo
+	Templates         []TemplateInfo
+	Sessions          []SessionInfo
+	ApiTokens         []ApiTokenInfo
+	Delegations       DelegationsResponse
+	AuditLog          []AuditEntry
+	ExportedAt        time.Time
+}
+
+// everything stored about the caller's account, except passwds and secrets
+func (t *SessionManager) ExportAccount(params *SessionOnlyParams) (AccountExport, error) {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export := AccountExport{User: account.User, NetId: account.NetId, Admin: account.Admin, ExportedAt: time.Now()}
+	err = t.db.QueryRowContext(context.Background(), "SELECT `email`, `created_at` FROM `accounts` WHERE `uid` = ?", account.Uid).Scan(&export.Email, &export.CreatedAt)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export.NetIds, err = t.ListNetIds(params)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	reservations, err := t.GetReservations(&GetReservationsParams{Session: params.Session, Page: 0, Limit: math.MaxInt32, SortBy: "CreatedAt", SortOrder: "desc"})
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export.Reservations = reservations.Result
+	export.ReservationEvents, err = t.queryReservationEvents("`reservation` IN (SELECT `uid` FROM `reservations` WHERE `account` = ?)", account.Uid)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export.Rules, err = t.ListRules(params)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export.Templates, err = t.ListTemplates(params)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export.Sessions, err = t.ListSessions(params)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export.ApiTokens, err = t.ListApiTokens(params)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export.Delegations, err = t.ListDelegations(params)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	audit, err := t.queryAudit(account.Uid, "", 0, math.MaxInt32)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export.AuditLog = audit.Result
+	return export, nil
+}
+
+type DeleteAccountParams struct {
+	Session   SessionId
+	Passwd    string
+	ClientIp  string
+	UserAgent string
+}
+
+// remove the caller's account and everything belonging to it, including
+// every stored NetID passwd. Only the audit log, which is append-only, and the
+// list of deleted users keep a record of the account.
+func (t *SessionManager) DeleteAccount(params *DeleteAccountParams) error {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return err
+	}
+	err = t.throttleLogin(account.User, params.ClientIp, func() error {
+		if !verifyPasswd(account.Passwd, params.Passwd) {
+			return TennisApiError{errorType: WrongPasswd}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		for _, query := range []string{
+			"DELETE FROM `reservation_events` WHERE `reservation` IN (SELECT `uid` FROM `reservations` WHERE `account` = ?)",
+			"DELETE FROM `reservations` WHERE `account` = ?",
+			"DELETE FROM `reservation_rules` WHERE `account` = ?",
+			"DELETE FROM `reservation_templates` WHERE `account` = ?",
+			"DELETE FROM `netids` WHERE `account` = ?",
+			"DELETE FROM `sessions` WHERE `account` = ?",
+			"DELETE FROM `api_tokens` WHERE `account` = ?",
+			"DELETE FROM `totp` WHERE `account` = ?",
+			"DELETE FROM `totp_recovery_codes` WHERE `account` = ?",
+			"DELETE FROM `passwd_resets` WHERE `account` = ?",
+			"DELETE FROM `delegations` WHERE `owner` = ?1 OR `delegate` = ?1",
+			"DELETE FROM `accounts` WHERE `uid` = ?",
+		} {
+			_, err := tx.ExecContext(ctx, query, account.Uid)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM `login_failures` WHERE `kind` = ? AND `key` = ?", login_throttle_account, account.User)
+		if err != nil {
+			return err
+		}
+		// keep user_data.csv from bringing the account back
+		_, err = tx.ExecContext(ctx, "INSERT INTO `deleted_accounts` (`user`) VALUES (?) ON CONFLICT (`user`) DO NOTHING", account.User)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	t.audit(account.Uid, account.Uid, AuditAccountDeleted, account.User, params.ClientIp, params.UserAgent)
+	return nil
+}
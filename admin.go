@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// validate the fields of a new account, returning it with passwd hashed and
+// NetID passwd sealed
+func (t *SessionManager) prepareAccount(user string, passwd string, netid string, netid_passwd string) (*Account, error) {
+	if user == "" {
+		return nil, TennisApiError{errorType: InvalidAccount, message: "User must not be empty"}
+	}
+	if netid == "" {
+		return nil, TennisApiError{errorType: InvalidAccount, message: "NetID must not be empty"}
+	}
+	err := t.passwdPolicy.check(user, passwd)
+	if err != nil {
+		return nil, err
+	}
+	err = checkNetIdPasswd(netid_passwd)
+	if err != nil {
+		return nil, err
+	}
+	if t.reserverPlugin != nil {
+		err = t.checkNetIdLogin(netid, netid_passwd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hash, err := hashPasswd(passwd)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := t.secrets.Seal(netid_passwd)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{User: user, Passwd: hash, NetId: netid, NetIdPasswd: sealed}, nil
+}
+
+func insertAccount(tx *sql.Tx, account *Account) (int64, error) {
+	res, err := tx.ExecContext(context.Background(), "INSERT INTO `accounts` (`user`, `passwd`, `netid`, `netid_passwd`, `admin`) VALUES (?, ?, ?, ?, ?) ON CONFLICT (`user`) DO NOTHING", account.User, account.Passwd, account.NetId, account.NetIdPasswd, account.Admin)
+	if err != nil {
+		return -1, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	if n == 0 {
+		return -1, TennisApiError{errorType: InvalidAccount, message: "User already exists"}
+	}
+	return res.LastInsertId()
+}
+
+// make an existing user an admin, to bootstrap the first one
+func GrantAdmin(db *sql.DB, user string) error {
+	res, err := db.ExecContext(context.Background(), "UPDATE `accounts` SET `admin` = 1 WHERE `user` = ?", user)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return TennisApiError{errorType: NonExistAccount}
+	}
+	return nil
+}
+
+func (t *SessionManager) getAdminSession(session SessionId) (*Account, error) {
+	account, err := t.getSession(session)
+	if err != nil {
+		return nil, err
+	}
+	if !account.Admin {
+		return nil, TennisApiError{errorType: PermissionDenied}
+	}
+	return account, nil
+}
+
+type AccountInfo struct {
+	Uid       int64
+	User      string
+	NetId     string
+	Admin     bool
+	Disabled  bool
+	CreatedAt time.Time
+}
+
+func (t *SessionManager) AdminListAccounts(params *SessionOnlyParams) ([]AccountInfo, error) {
+	_, err := t.getAdminSession(params.Session)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `uid`, `user`, `netid`, `admin`, `disabled`, `created_at` FROM `accounts` ORDER BY `uid` ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ans := make([]AccountInfo, 0)
+	for rows.Next() {
+		var info AccountInfo
+		err = rows.Scan(&info.Uid, &info.User, &info.NetId, &info.Admin, &info.Disabled, &info.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, info)
+	}
+	return ans, rows.Err()
+}
+
+type AdminCreateAccountParams struct {
+	Session     SessionId
+	User        string
+	Passwd      string
+	NetId       string
+	NetIdPasswd string
+	Admin       bool
+}
+
+func (t *SessionManager) AdminCreateAccount(params *AdminCreateAccountParams) (int64, error) {
+	_, err := t.getAdminSession(params.Session)
+	if err != nil {
+		return -1, err
+	}
+	account, err := t.prepareAccount(params.User, params.Passwd, params.NetId, params.NetIdPasswd)
+	if err != nil {
+		return -1, err
+	}
+	account.Admin = params.Admin
+	var uid int64
+	err = t.withTx(func(tx *sql.Tx) error {
+		uid, err = insertAccount(tx, account)
+		return err
+	})
+	return uid, err
+}
+
+type AdminSetAccountDisabledParams struct {
+	Session   SessionId
+	Uid       int64
+	Disabled  bool
+	ClientIp  string
+	UserAgent string
+}
+
+// a disabled account is signed out everywhere, cannot sign in and has its
+// pending reservations failed instead of booked
+func (t *SessionManager) AdminSetAccountDisabled(params *AdminSetAccountDisabledParams) error {
+	admin, err := t.getAdminSession(params.Session)
+	if err != nil {
+		return err
+	}
+	if params.Uid == admin.Uid {
+		return TennisApiError{errorType: InvalidQuery, message: "Cannot disable your own account"}
+	}
+	err = t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		res, err := tx.ExecContext(ctx, "UPDATE `accounts` SET `disabled` = ? WHERE `uid` = ?", params.Disabled, params.Uid)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return TennisApiError{errorType: InvalidQuery, message: "No matching account"}
+		}
+		if params.Disabled {
+			_, err = tx.ExecContext(ctx, "DELETE FROM `sessions` WHERE `account` = ?", params.Uid)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	action := AuditAccountEnabled
+	if params.Disabled {
+		action = AuditAccountDisabled
+	}
+	t.audit(params.Uid, admin.Uid, action, "", params.ClientIp, params.UserAgent)
+	return nil
+}
+
+type AdminResetPasswdParams struct {
+	Session   SessionId
+	Uid       int64
+	NewPasswd string
+	ClientIp  string
+	UserAgent string
+}
+
+// set a new passwd for an account, signing it out everywhere
+func (t *SessionManager) AdminResetPasswd(params *AdminResetPasswdParams) error {
+	admin, err := t.getAdminSession(params.Session)
+	if err != nil {
+		return err
+	}
+	account, err := getAccount(t.db, params.Uid)
+	if _, ok := err.(TennisApiError); ok {
+		return TennisApiError{errorType: InvalidQuery, message: "No matching account"}
+	}
+	if err != nil {
+		return err
+	}
+	err = t.passwdPolicy.check(account.User, params.NewPasswd)
+	if err != nil {
+		return err
+	}
+	hash, err := hashPasswd(params.NewPasswd)
+	if err != nil {
+		return err
+	}
+	err = t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		res, err := tx.ExecContext(ctx, "UPDATE `accounts` SET `passwd` = ? WHERE `uid` = ?", hash, params.Uid)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return TennisApiError{errorType: InvalidQuery, message: "No matching account"}
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM `sessions` WHERE `account` = ?", params.Uid)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	t.audit(params.Uid, admin.Uid, AuditPasswdReset, "", params.ClientIp, params.UserAgent)
+	return nil
+}
+
+type AdminMintInviteParams struct {
+	Session SessionId
+	MaxUses int
+	// e.g. "168h"
+	Expiry string
+}
+
+func (t *SessionManager) AdminMintInvite(params *AdminMintInviteParams) (string, error) {
+	_, err := t.getAdminSession(params.Session)
+	if err != nil {
+		return "", err
+	}
+	expiry, err := time.ParseDuration(params.Expiry)
+	if err != nil || expiry <= 0 {
+		return "", TennisApiError{errorType: MalformedData, message: "Invalid expiry"}
+	}
+	return MintInviteCode(t.db, params.MaxUses, expiry)
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestAdminResetPasswdChecksPolicy(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	err := GrantAdmin(db, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := testLogin(t, s, "foo", "pw")
+	var bar int64
+	db.QueryRow("SELECT `uid` FROM `accounts` WHERE `user` = 'bar'").Scan(&bar)
+
+	// the policy refuses the user name as passwd
+	err = s.AdminResetPasswd(&AdminResetPasswdParams{Session: admin, Uid: bar, NewPasswd: "BAR"})
+	if api_err, ok := err.(TennisApiError); !ok || api_err.errorType != InvalidPasswd {
+		t.Fatalf("user name accepted as passwd: %v", err)
+	}
+	err = s.AdminResetPasswd(&AdminResetPasswdParams{Session: admin, Uid: 12345, NewPasswd: "fresh-pw"})
+	if api_err, ok := err.(TennisApiError); !ok || api_err.errorType != InvalidQuery {
+		t.Fatalf("reset of a missing account: %v", err)
+	}
+	err = s.AdminResetPasswd(&AdminResetPasswdParams{Session: admin, Uid: bar, NewPasswd: "fresh-pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLogin(t, s, "bar", "fresh-pw")
+}
@@ -2,13 +2,12 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -36,6 +35,11 @@ const (
 	InvalidPasswd
 	NotLoggedIn
 	InvalidQuery
+	TooManyAttempts
+	WrongTotpCode
+	NetIdLoginFailed
+	ReserverUnavailable
+	PermissionDenied
 )
 
 func (t TennisApiError) Error() string {
@@ -51,11 +55,24 @@ func (t TennisApiError) Error() string {
 	case WrongPasswd:
 		return "Wrong Passwd"
 	case InvalidPasswd:
+		if t.message != "" {
+			return "Invalid Passwd: " + t.message
+		}
 		return "Invalid Passwd"
 	case NotLoggedIn:
 		return "Not Logged In"
 	case InvalidQuery:
 		return "Invalid Query: " + t.message
+	case TooManyAttempts:
+		return "Too Many Attempts: " + t.message
+	case WrongTotpCode:
+		return "Wrong TOTP Code"
+	case NetIdLoginFailed:
+		return "NetID Login Failed: " + t.message
+	case ReserverUnavailable:
+		return "Reserver Unavailable: " + t.message
+	case PermissionDenied:
+		return "Permission Denied"
 	}
 	panic("Error not covered")
 }
@@ -78,116 +95,123 @@ func (t TennisApiError) ToHttpStatus() int {
 		return http.StatusForbidden
 	case InvalidQuery:
 		return http.StatusBadRequest
+	case TooManyAttempts:
+		return http.StatusTooManyRequests
+	case WrongTotpCode:
+		return http.StatusForbidden
+	case NetIdLoginFailed:
+		return http.StatusBadRequest
+	case ReserverUnavailable:
+		return http.StatusServiceUnavailable
+	case PermissionDenied:
+		return http.StatusForbidden
 	}
 	panic("Error not covered")
 }
 
 type Account struct {
+	Uid         int64
 	User        string
 	Passwd      string
 	NetId       string
 	NetIdPasswd string
+	Admin       bool
+	Disabled    bool
 }
 
 type SessionId string
 
-type Session struct {
-	Expiry  time.Time
-	Account *Account
-} // write-through cache of user_data.csv
-
 type SessionManager struct {
-	accounts       []Account
-	account_mutex  sync.RWMutex
-	sessions       sync.Map
-	conn           *sql.Conn
+	pendingLogins  sync.Map
+	db             *sql.DB
+	secrets        *SecretBox
+	loginThrottle  LoginThrottleConfig
+	passwdPolicy   PasswdPolicy
+	mail           MailConfig
+	ssoWhitelist   map[string]bool
 	timeZone       *time.Location
 	captchaSolver  captcha_solver.CaptchaSolver
 	reserverPlugin *CourtReserverPlugin
 }
 
-const user_data_file = "user_data.csv"
-const account_login_expiry = 24 * time.Hour
-
-type ParseError struct{}
-
-func (t ParseError) Error() string {
-	return "Error: ParseError"
+type SessionManagerConfig struct {
+	LoginThrottle LoginThrottleConfig
+	PasswdPolicy  PasswdPolicy
+	Mail          MailConfig
+	// NetIDs that get an account on their first SSO login
+	SsoWhitelist map[string]bool
 }
 
-func NewSessionManager(conn *sql.Conn, captcha_solver captcha_solver.CaptchaSolver, court_reserver_plugin *CourtReserverPlugin) (*SessionManager, error) {
+func NewSessionManager(db *sql.DB, secrets *SecretBox, config SessionManagerConfig, captcha_solver captcha_solver.CaptchaSolver, court_reserver_plugin *CourtReserverPlugin) (*SessionManager, error) {
 	time_zone, err := time.LoadLocation("Asia/Shanghai")
 	if err != nil {
 		panic("Invalid time zone")
 	}
-	data, err := os.ReadFile(user_data_file)
-	if err != nil {
-		return nil, err
-	}
-	account_strs := strings.Split(string(data), "\n")
-	accounts := make([]Account, 0)
-
-	for _, account_str := range account_strs {
-		if account_str == "" {
-			continue // skip empty lines
-		}
-		fields := strings.Split(account_str, ",")
-		if len(fields) != 4 {
-			return nil, ParseError{}
-		}
-		account := Account{
-			User:        fields[0],
-			Passwd:      fields[1],
-			NetId:       fields[2],
-			NetIdPasswd: fields[3],
-		}
-		accounts = append(accounts, account)
-	}
 	return &SessionManager{
-		accounts:       accounts,
-		account_mutex:  sync.RWMutex{},
-		sessions:       sync.Map{},
-		conn:           conn,
+		pendingLogins:  sync.Map{},
+		db:             db,
+		secrets:        secrets,
+		loginThrottle:  config.LoginThrottle,
+		passwdPolicy:   config.PasswdPolicy,
+		mail:           config.Mail,
+		ssoWhitelist:   config.SsoWhitelist,
 		timeZone:       time_zone,
 		captchaSolver:  captcha_solver,
 		reserverPlugin: court_reserver_plugin,
 	}, nil
 }
 
-// Unlock write lock before calling WriteAccounts
-func (t *SessionManager) WriteAccounts() error {
-	t.account_mutex.RLock()
-	var ans = ""
-	for _, account := range t.accounts {
-		temp := fmt.Sprintf("%s,%s,%s,%s\n", account.User, account.Passwd, account.NetId, account.NetIdPasswd)
-		ans += temp
+// run callback in a transaction on a connection of its own, so statements of
+// other requests never become part of it. On a database opened by
+// openDatabase, it takes the write lock up front and waits for other writers.
+func (t *SessionManager) withTx(callback func(tx *sql.Tx) error) error {
+	tx, err := t.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
 	}
-	t.account_mutex.RUnlock()
-	return os.WriteFile(user_data_file, []byte(ans), 0600)
-}
-
-func newSessionId() SessionId {
-	rand_bytes := make([]byte, 32)
-	_, err := rand.Read(rand_bytes)
+	err = callback(tx)
 	if err != nil {
-		panic(err)
+		tx.Rollback()
+		return err
 	}
-	return SessionId(base64.StdEncoding.EncodeToString(rand_bytes))
+	return tx.Commit()
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
 }
 
-func CheckPasswd(passwd string) (ok bool) {
-	if strings.Contains(passwd, ",") {
-		return false
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+const account_columns = "`uid`, `user`, `passwd`, `netid`, `netid_passwd`, `admin`, `disabled`"
+
+func scanAccount(row *sql.Row) (*Account, error) {
+	var account Account
+	err := row.Scan(&account.Uid, &account.User, &account.Passwd, &account.NetId, &account.NetIdPasswd, &account.Admin, &account.Disabled)
+	if err == sql.ErrNoRows {
+		return nil, TennisApiError{errorType: NonExistAccount}
 	}
-	if strings.Contains(passwd, "\n") {
-		return false
+	if err != nil {
+		return nil, err
 	}
-	return true
+	return &account, nil
+}
+
+func getAccount(db queryRower, uid int64) (*Account, error) {
+	return scanAccount(db.QueryRowContext(context.Background(), "SELECT "+account_columns+" FROM `accounts` WHERE `uid` = ?", uid))
+}
+
+func getAccountByUser(db queryRower, user string) (*Account, error) {
+	return scanAccount(db.QueryRowContext(context.Background(), "SELECT "+account_columns+" FROM `accounts` WHERE `user` = ?", user))
 }
 
 type LoginParams struct {
-	User   string
-	Passwd string
+	User      string
+	Passwd    string
+	ClientIp  string
+	UserAgent string
 }
 type VersionResponse struct {
 	MainVersion     string
@@ -205,89 +229,155 @@ func (t *SessionManager) Version() (VersionResponse, error) {
 	}, nil
 }
 
-func (t *SessionManager) Login(params *LoginParams) (SessionId, error) {
+// returns the new SessionId, or a TotpChallenge to be answered by LoginTotp
+// if the account has TOTP enabled
+func (t *SessionManager) Login(params *LoginParams) (interface{}, error) {
 	var login_account *Account = nil
-	for i, account := range t.accounts {
-		if account.User == params.User {
-			if account.Passwd != params.Passwd {
-				return "", TennisApiError{errorType: WrongPasswd}
+	err := t.throttleLogin(params.User, params.ClientIp, func() error {
+		// bcrypt is slow, so it must not run while holding the write lock
+		account, err := getAccountByUser(t.db, params.User)
+		if err != nil {
+			return err
+		}
+		if !verifyPasswd(account.Passwd, params.Passwd) {
+			return TennisApiError{errorType: WrongPasswd}
+		}
+		if account.Disabled {
+			return TennisApiError{errorType: InvalidAccount, message: "Account disabled"}
+		}
+		// upgrade legacy plaintext passwd now that we know it is correct
+		if !isPasswdHash(account.Passwd) {
+			hash, err := hashPasswd(params.Passwd)
+			if err != nil {
+				return err
+			}
+			err = t.withTx(func(tx *sql.Tx) error {
+				// unless it has been changed in the meantime
+				_, err := tx.ExecContext(context.Background(), "UPDATE `accounts` SET `passwd` = ? WHERE `uid` = ? AND `passwd` = ?", hash, account.Uid, account.Passwd)
+				return err
+			})
+			if err != nil {
+				return err
 			}
-			login_account = &t.accounts[i]
 		}
-	}
-	if login_account == nil {
-		return "", TennisApiError{errorType: NonExistAccount}
-	}
-	session_id := newSessionId()
-	t.sessions.Store(session_id, Session{
-		Expiry:  time.Now().Add(account_login_expiry),
-		Account: login_account,
+		login_account = account
+		return nil
 	})
-	return session_id, nil
-}
-func (t *SessionManager) getSession(session SessionId) (*Account, error) {
-	val, ok := t.sessions.Load(session)
-	if !ok {
-		return nil, TennisApiError{errorType: NotLoggedIn}
+	if err != nil {
+		t.auditLogin(params.User, "passwd", err, params.ClientIp, params.UserAgent)
+		return nil, err
+	}
+	ans, err := t.completeLogin(login_account, params.ClientIp, params.UserAgent)
+	// with TOTP, the login is only complete once LoginTotp succeeds
+	if _, ok := ans.(SessionId); ok && err == nil {
+		t.audit(login_account.Uid, login_account.Uid, AuditLogin, "passwd", params.ClientIp, params.UserAgent)
 	}
-	return val.(Session).Account, nil
+	return ans, err
 }
 
 type ChangePasswdParams struct {
-	Session   SessionId
-	OldPasswd string
-	NewPasswd string
+	Session             SessionId
+	OldPasswd           string
+	NewPasswd           string
+	RevokeOtherSessions bool
+	ClientIp            string
+	UserAgent           string
 }
 
 func (t *SessionManager) ChangePasswd(params *ChangePasswdParams) error {
-	account, err := t.getSession(params.Session)
+	account, err := t.getInteractiveSession(params.Session)
 	if err != nil {
 		return err
 	}
 	// check if new_passwd is valid
-	if !CheckPasswd(params.NewPasswd) {
-		return TennisApiError{errorType: InvalidPasswd}
+	err = t.passwdPolicy.check(account.User, params.NewPasswd)
+	if err != nil {
+		return err
 	}
-	// check old passwd
-	t.account_mutex.RLock()
-	passwd_match := account.Passwd == params.OldPasswd
-	t.account_mutex.RUnlock()
-
-	if !passwd_match {
+	hash, err := hashPasswd(params.NewPasswd)
+	if err != nil {
+		return err
+	}
+	// check old passwd, outside the transaction as bcrypt is slow
+	if !verifyPasswd(account.Passwd, params.OldPasswd) {
 		return TennisApiError{errorType: WrongPasswd}
 	}
-	// mutex lock for writing new passwd
-	t.account_mutex.Lock()
-	account.Passwd = params.NewPasswd
-	t.account_mutex.Unlock()
-
-	// write back
-	defer t.WriteAccounts()
+	err = t.withTx(func(tx *sql.Tx) error {
+		// a passwd changed in the meantime was not the one checked
+		res, err := tx.ExecContext(context.Background(), "UPDATE `accounts` SET `passwd` = ? WHERE `uid` = ? AND `passwd` = ?", hash, account.Uid, account.Passwd)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return TennisApiError{errorType: WrongPasswd}
+		}
+		if params.RevokeOtherSessions {
+			return revokeOtherSessions(tx, account.Uid, params.Session)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.audit(account.Uid, account.Uid, AuditPasswdChange, "", params.ClientIp, params.UserAgent)
 	return nil
 }
 
 type ChangeNetIdPasswdParams struct {
-	Session   SessionId
-	NewPasswd string
+	Session             SessionId
+	NewPasswd           string
+	RevokeOtherSessions bool
+	ClientIp            string
+	UserAgent           string
 }
 
 func (t *SessionManager) ChangeNetIdPasswd(params *ChangeNetIdPasswdParams) error {
-	account, err := t.getSession(params.Session)
+	account, err := t.getInteractiveSession(params.Session)
 	if err != nil {
 		return err
 	}
 	// check if new_passwd is valid
-	if !CheckPasswd(params.NewPasswd) {
-		return TennisApiError{errorType: InvalidPasswd}
+	err = checkNetIdPasswd(params.NewPasswd)
+	if err != nil {
+		return err
 	}
-
-	// mutex lock for writing new passwd
-	t.account_mutex.Lock()
-	account.NetIdPasswd = params.NewPasswd
-	t.account_mutex.Unlock()
-
-	// write back
-	defer t.WriteAccounts()
+	// catch typos now rather than at the next wakeUp. Without a reserver
+	// plugin there is nothing to check against, nor anything that would fail.
+	if t.reserverPlugin != nil {
+		err = t.checkNetIdLogin(account.NetId, params.NewPasswd)
+		if err != nil {
+			return err
+		}
+	}
+	sealed, err := t.secrets.Seal(params.NewPasswd)
+	if err != nil {
+		return err
+	}
+	err = t.withTx(func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(context.Background(), "UPDATE `accounts` SET `netid_passwd` = ? WHERE `uid` = ?", sealed, account.Uid)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return TennisApiError{errorType: NonExistAccount}
+		}
+		if params.RevokeOtherSessions {
+			return revokeOtherSessions(tx, account.Uid, params.Session)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.audit(account.Uid, account.Uid, AuditNetIdPasswdChange, account.NetId, params.ClientIp, params.UserAgent)
 	return nil
 }
 
@@ -300,15 +390,30 @@ func (t *SessionManager) GetLoginAccount(params *SessionOnlyParams) (*Account, e
 	if err != nil {
 		return nil, err
 	}
-	// only returning User, NetId
+	// only returning User, NetId, Admin
 	cloneAccount := Account{
 		User:  account.User,
 		NetId: account.NetId,
+		Admin: account.Admin,
 	}
 	return &cloneAccount, nil
 }
-func (t *SessionManager) SignOut(params *SessionOnlyParams) {
-	t.sessions.Delete(params.Session)
+
+type SignOutParams struct {
+	Session   SessionId
+	ClientIp  string
+	UserAgent string
+}
+
+func (t *SessionManager) SignOut(params *SignOutParams) {
+	account, err := t.getSession(params.Session)
+	if err == nil {
+		t.audit(account.Uid, account.Uid, AuditSignOut, "", params.ClientIp, params.UserAgent)
+	}
+	err = t.deleteSession(params.Session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR Session SQL] %s %s\n", time.Now().Format(time.RFC3339), err.Error())
+	}
 }
 
 type SingleBookCompatible struct {
@@ -341,31 +446,28 @@ type ReservationCompatible struct {
 type PlaceReservationParams struct {
 	Session     SessionId
 	Reservation ReservationCompatible
+	// NetID to book with, empty for the primary one
+	NetId string
+	// user to book for through a delegation, empty for oneself
+	Target    string
+	ClientIp  string
+	UserAgent string
 }
 
 const DATE_FORMAT = "2006-01-02"
 
-func (t *SessionManager) PlaceReservation(params *PlaceReservationParams) (int64, error) {
-	account, err := t.getSession(params.Session)
-	if err != nil {
-		return -1, err
-	}
-	t.account_mutex.RLock()
-	netid := account.NetId
-	netid_passwd := account.NetIdPasswd
-	t.account_mutex.RUnlock()
-	data, err := json.Marshal(params.Reservation.Preferences)
-	if err != nil {
-		return -1, err
-	}
-	date, err := time.ParseInLocation(DATE_FORMAT, params.Reservation.Date, t.timeZone)
+// when a reservation for reservation.Date gets booked: the day booking for
+// it opens, or, if that has passed, the next booking window. book_now tells
+// whether the current booking window is open, so it should be booked at once.
+func (t *SessionManager) reserveOn(reservation *ReservationCompatible) (date time.Time, reserve_on string, book_now bool, err error) {
+	date, err = time.ParseInLocation(DATE_FORMAT, reservation.Date, t.timeZone)
 	now := time.Now().In(t.timeZone)
 	today_y, today_m, today_d := now.Date()
 	today_start := time.Date(today_y, today_m, today_d, 0, 0, 0, 0, t.timeZone)
 	if err != nil || date.Before(today_start) {
-		return -1, TennisApiError{MalformedData, "Invalid date"}
+		return date, "", false, TennisApiError{MalformedData, "Invalid date"}
 	}
-	reservation_date := date.Add(-time.Duration(court_reserver_interface.SiteLookahead(params.Reservation.Site)) * 24 * time.Hour)
+	reservation_date := date.Add(-time.Duration(court_reserver_interface.SiteLookahead(reservation.Site)) * 24 * time.Hour)
 	res_y, res_m, res_d := reservation_date.Date()
 	reservation_booking_start := time.Date(res_y, res_m, res_d, 0, 0, 0, 0, t.timeZone).Add(BOOKING_START)
 
@@ -373,7 +475,7 @@ func (t *SessionManager) PlaceReservation(params *PlaceReservationParams) (int64
 	today_booking_end := time.Date(today_y, today_m, today_d, 0, 0, 0, 0, t.timeZone).Add(BOOKING_END)
 
 	// book immediately if in booking time
-	var reserve_on string = reservation_date.Format(DATE_FORMAT)
+	reserve_on = reservation_date.Format(DATE_FORMAT)
 
 	if now.After(reservation_booking_start) {
 		// if now is available for booking, book now
@@ -384,13 +486,82 @@ func (t *SessionManager) PlaceReservation(params *PlaceReservationParams) (int64
 			reserve_on = today_booking_start.Add(time.Duration(24) * time.Hour).Format(DATE_FORMAT)
 		}
 	}
+	// But if no reserver plugin is find, do not reserve.
+	book_now = t.reserverPlugin != nil && now.After(reservation_booking_start) && now.After(today_booking_start) && now.Before(today_booking_end)
+	return date, reserve_on, book_now, nil
+}
+
+// book reservation uid in the background, outside of wakeUp
+func (t *SessionManager) bookNow(uid int64, netid string, netid_passwd string, date time.Time, params *ReservationCompatible) {
+	books := make([]court_reserver_interface.SingleBook, 0, len(params.Preferences))
+	for _, v := range params.Preferences {
+		books = append(books, v.convert())
+	}
+	reservation := court_reserver_interface.Reservation{
+		Date:        date,
+		Site:        params.Site,
+		Preferences: books,
+		Priority:    params.Priority,
+	}
+	go (func() {
+		// only decrypt the NetID passwd right before logging in
+		var redir string
+		passwd, err := t.secrets.Open(netid_passwd)
+		if err == nil {
+			login_session := xjtuorg.New(true)
+			redir, err = login_session.Login(t.reserverPlugin.LoginURL, netid, passwd)
+		}
+
+		// cannot login, return all failed.
+		// reuse login
+		if err != nil {
+			UpdateReservation(t.db, uid, court_reserver_interface.ReservationStatus{
+				Code:      court_reserver_interface.Failed,
+				Msg:       fmt.Sprintf("Login Error: %s", err.Error()),
+				CourtTime: make(map[string]string),
+			}, EventSourceImmediate)
+			fmt.Fprintf(os.Stderr, "[ERROR Session LOGIN] %s %s", time.Now().Format(time.RFC3339), err.Error())
+			return
+		}
+		reserver := t.reserverPlugin.NewCourtReserver(redir)
+		status := reserver.BookNow(t.timeZone, &reservation, t.captchaSolver)
+
+		err = UpdateReservation(t.db, uid, status, EventSourceImmediate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR Session SQL] %s %s", time.Now().Format(time.RFC3339), err.Error())
+		}
+	})()
+}
+
+func (t *SessionManager) PlaceReservation(params *PlaceReservationParams) (int64, error) {
+	caller, err := t.getSession(params.Session)
+	if err != nil {
+		return -1, err
+	}
+	account, err := t.resolveTarget(caller, params.Target, true)
+	if err != nil {
+		return -1, err
+	}
+	netid, netid_passwd, err := resolveNetId(t.db, account, params.NetId)
+	if err != nil {
+		return -1, err
+	}
+	data, err := json.Marshal(params.Reservation.Preferences)
+	if err != nil {
+		return -1, err
+	}
+	date, reserve_on, book_now, err := t.reserveOn(&params.Reservation)
+	if err != nil {
+		return -1, err
+	}
 
 	ctx := context.Background()
-	stmt, err := t.conn.PrepareContext(ctx, "INSERT INTO `reservations` (`netid`, `passwd`, `date`, `site`, `preferences`, `priority`, `reserve_on`) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	// a reservation booked right away is picked up from the start
+	stmt, err := t.db.PrepareContext(ctx, "INSERT INTO `reservations` (`account`, `netid`, `passwd`, `date`, `site`, `preferences`, `priority`, `reserve_on`, `picked_up`) VALUES (?, ?, '', ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return -1, err
 	}
-	res, err := stmt.Exec(netid, netid_passwd, params.Reservation.Date, params.Reservation.Site, data, params.Reservation.Priority, reserve_on)
+	res, err := stmt.Exec(account.Uid, netid, params.Reservation.Date, params.Reservation.Site, data, params.Reservation.Priority, reserve_on, book_now)
 	if err != nil {
 		return -1, err
 	}
@@ -398,81 +569,118 @@ func (t *SessionManager) PlaceReservation(params *PlaceReservationParams) (int64
 	if err != nil {
 		return -1, err
 	}
-
-	// book immediately if in booking time.
-	// But if no reserver plugin is find, do not reserve.
-	if t.reserverPlugin == nil {
-		return uid, err
+	t.audit(account.Uid, caller.Uid, AuditReservationPlaced, fmt.Sprintf("#%d %s site %d with %s", uid, params.Reservation.Date, params.Reservation.Site, netid), params.ClientIp, params.UserAgent)
+	err = recordReservationEvent(t.db, uid, EventSourceUser, court_reserver_interface.ReservationStatus{Code: court_reserver_interface.Pending, Msg: "Placed, booking on " + reserve_on})
+	if err != nil {
+		return -1, err
 	}
-	if now.After(reservation_booking_start) && now.After(today_booking_start) && now.Before(today_booking_end) {
-		books := make([]court_reserver_interface.SingleBook, 0, len(params.Reservation.Preferences))
-		for _, v := range params.Reservation.Preferences {
-			books = append(books, v.convert())
-		}
-		reservation := court_reserver_interface.Reservation{
-			Date:        date,
-			Site:        params.Reservation.Site,
-			Preferences: books,
-			Priority:    params.Reservation.Priority,
-		}
-		go (func() {
-			login_session := xjtuorg.New(true)
-			redir, err := login_session.Login(t.reserverPlugin.LoginURL, account.NetId, account.NetIdPasswd)
-
-			// cannot login, return all failed.
-			// reuse login
-			if err != nil {
-				UpdateReservation(t.conn, uid, court_reserver_interface.ReservationStatus{
-					Code:      court_reserver_interface.Failed,
-					Msg:       fmt.Sprintf("Login Error: %s", err.Error()),
-					CourtTime: make(map[string]string),
-				})
-				fmt.Fprintf(os.Stderr, "[ERROR Session LOGIN] %s %s", time.Now().Format(time.RFC3339), err.Error())
-				return
-			}
-			reserver := t.reserverPlugin.NewCourtReserver(redir)
-			status := reserver.BookNow(t.timeZone, &reservation, t.captchaSolver)
 
-			err = UpdateReservation(t.conn, uid, status)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "[ERROR Session SQL] %s %s", time.Now().Format(time.RFC3339), err.Error())
-			}
-		})()
+	// book immediately if in booking time.
+	if book_now {
+		t.bookNow(uid, netid, netid_passwd, date, &params.Reservation)
 	}
-	return uid, err
+	return uid, nil
 }
 
 type CancelReservationParams struct {
 	Session SessionId
 	Uid     int64
+	// user whose reservation to cancel through a delegation, empty for oneself
+	Target    string
+	ClientIp  string
+	UserAgent string
 }
 
 func (t *SessionManager) CancelReservation(params *CancelReservationParams) error {
 
-	account, err := t.getSession(params.Session)
+	caller, err := t.getSession(params.Session)
+	if err != nil {
+		return err
+	}
+	account, err := t.resolveTarget(caller, params.Target, true)
 	if err != nil {
 		return err
 	}
 
-	t.account_mutex.RLock()
-	netid := account.NetId
-	t.account_mutex.RUnlock()
-	res, err := t.conn.ExecContext(context.Background(), fmt.Sprintf("DELETE FROM `reservations` WHERE `netid` = ? AND `uid` = ? AND `status_code` = %d", int(court_reserver_interface.Pending)), netid, params.Uid)
+	// the history goes with the reservation; the audit log keeps the cancel
+	err = t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		res, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM `reservations` WHERE `account` = ? AND `uid` = ? AND `status_code` = %d", int(court_reserver_interface.Pending)), account.Uid, params.Uid)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return TennisApiError{errorType: InvalidQuery, message: "No matching reservation"}
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM `reservation_events` WHERE `reservation` = ?", params.Uid)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	t.audit(account.Uid, caller.Uid, AuditReservationCancel, fmt.Sprintf("#%d", params.Uid), params.ClientIp, params.UserAgent)
+	return nil
+}
+
+type EditReservationParams struct {
+	Session     SessionId
+	Uid         int64
+	Reservation ReservationCompatible
+	// user whose reservation to edit through a delegation, empty for oneself
+	Target    string
+	ClientIp  string
+	UserAgent string
+}
+
+// change a reservation that is still pending and has not been picked up by
+// the reserver, keeping its uid. reserve_on is computed anew.
+func (t *SessionManager) EditReservation(params *EditReservationParams) error {
+	caller, err := t.getSession(params.Session)
 	if err != nil {
 		return err
 	}
-	n, err := res.RowsAffected()
+	account, err := t.resolveTarget(caller, params.Target, true)
 	if err != nil {
 		return err
 	}
-	if n == 0 {
-		return TennisApiError{errorType: InvalidQuery, message: "No matching reservation"}
+	data, err := json.Marshal(params.Reservation.Preferences)
+	if err != nil {
+		return err
+	}
+	date, reserve_on, book_now, err := t.reserveOn(&params.Reservation)
+	if err != nil {
+		return err
+	}
+	var netid string
+	err = t.db.QueryRowContext(context.Background(), fmt.Sprintf("UPDATE `reservations` SET `date` = ?, `site` = ?, `preferences` = ?, `priority` = ?, `reserve_on` = ?, `picked_up` = ? WHERE `account` = ? AND `uid` = ? AND `status_code` = %d AND `picked_up` = 0 RETURNING `netid`", int(court_reserver_interface.Pending)), params.Reservation.Date, params.Reservation.Site, data, params.Reservation.Priority, reserve_on, book_now, account.Uid, params.Uid).Scan(&netid)
+	if err == sql.ErrNoRows {
+		return TennisApiError{errorType: InvalidQuery, message: "No matching reservation, or it is already being booked"}
+	}
+	if err != nil {
+		return err
+	}
+	t.audit(account.Uid, caller.Uid, AuditReservationEdited, fmt.Sprintf("#%d %s site %d", params.Uid, params.Reservation.Date, params.Reservation.Site), params.ClientIp, params.UserAgent)
+	err = recordReservationEvent(t.db, params.Uid, EventSourceUser, court_reserver_interface.ReservationStatus{Code: court_reserver_interface.Pending, Msg: "Edited, booking on " + reserve_on})
+	if err != nil {
+		return err
+	}
+	if book_now {
+		netid_passwd, err := lookupNetIdPasswd(t.db, account.Uid, netid)
+		if err != nil {
+			return err
+		}
+		t.bookNow(params.Uid, netid, netid_passwd, date, &params.Reservation)
 	}
 	return nil
 }
 
 type ReservationResult struct {
 	Uid         int64
+	NetId       string
 	Reservation ReservationCompatible
 	Status      court_reserver_interface.ReservationStatus
 }
@@ -484,37 +692,133 @@ type GetReservationsParams struct {
 	Session SessionId
 	Page    uint
 	Limit   uint
+	// user whose reservations to list through a delegation, empty for oneself
+	Target string
+	// filters, each ignored when empty. Status is a comma separated list of
+	// status codes, the ranges are inclusive and Search matches Msg.
+	Status        string
+	Site          string
+	DateFrom      string
+	DateTo        string
+	ReserveOnFrom string
+	ReserveOnTo   string
+	Search        string
+	// one of reservation_sort_columns, and "asc" or "desc"
+	SortBy    string
+	SortOrder string
+}
+
+var reservation_sort_columns = map[string]string{
+	"CreatedAt": "created_at",
+	"Date":      "date",
+	"ReserveOn": "reserve_on",
+	"Priority":  "priority",
+	"Site":      "site",
+	"Status":    "status_code",
+}
+
+// build the WHERE and ORDER BY clauses of a reservation listing of account
+func (t *GetReservationsParams) query(account int64) (string, []any, string, error) {
+	where := "`account` = ?"
+	args := []any{account}
+	if t.Status != "" {
+		codes := strings.Split(t.Status, ",")
+		placeholders := make([]string, 0, len(codes))
+		for _, code := range codes {
+			value, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil {
+				return "", nil, "", TennisApiError{errorType: MalformedData, message: "Invalid status"}
+			}
+			placeholders = append(placeholders, "?")
+			args = append(args, value)
+		}
+		where += " AND `status_code` IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	if t.Site != "" {
+		site, err := strconv.Atoi(t.Site)
+		if err != nil {
+			return "", nil, "", TennisApiError{errorType: MalformedData, message: "Invalid site"}
+		}
+		where += " AND `site` = ?"
+		args = append(args, site)
+	}
+	// dates are stored as DATE_FORMAT strings, which sort chronologically
+	for _, bound := range []struct {
+		value string
+		cond  string
+	}{
+		{t.DateFrom, " AND `date` >= ?"},
+		{t.DateTo, " AND `date` <= ?"},
+		{t.ReserveOnFrom, " AND `reserve_on` >= ?"},
+		{t.ReserveOnTo, " AND `reserve_on` <= ?"},
+	} {
+		if bound.value == "" {
+			continue
+		}
+		if _, err := time.Parse(DATE_FORMAT, bound.value); err != nil {
+			return "", nil, "", TennisApiError{errorType: MalformedData, message: "Invalid date"}
+		}
+		where += bound.cond
+		args = append(args, bound.value)
+	}
+	if t.Search != "" {
+		escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(t.Search)
+		where += " AND `msg` LIKE ? ESCAPE '\\'"
+		args = append(args, "%"+escaped+"%")
+	}
+	column, ok := reservation_sort_columns[t.SortBy]
+	if !ok {
+		return "", nil, "", TennisApiError{errorType: MalformedData, message: "Invalid sort field"}
+	}
+	var order string
+	switch strings.ToLower(t.SortOrder) {
+	case "asc":
+		order = "ASC"
+	case "desc":
+		order = "DESC"
+	default:
+		return "", nil, "", TennisApiError{errorType: MalformedData, message: "Invalid sort order"}
+	}
+	// uid breaks ties, so that pages do not overlap
+	return where, args, fmt.Sprintf("`%s` %s, `uid` %s", column, order, order), nil
 }
 
 func (t *SessionManager) GetReservations(params *GetReservationsParams) (ReservationResponse, error) {
-	account, err := t.getSession(params.Session)
+	caller, err := t.getSession(params.Session)
+	if err != nil {
+		return ReservationResponse{Count: 0, Result: nil}, err
+	}
+	account, err := t.resolveTarget(caller, params.Target, false)
+	if err != nil {
+		return ReservationResponse{Count: 0, Result: nil}, err
+	}
+	where, args, order_by, err := params.query(account.Uid)
 	if err != nil {
 		return ReservationResponse{Count: 0, Result: nil}, err
 	}
 
-	t.account_mutex.RLock()
-	netid := account.NetId
-	t.account_mutex.RUnlock()
 	offset := params.Page * params.Limit
 	var count uint
-	err = t.conn.QueryRowContext(context.Background(), "SELECT COUNT(`uid`) FROM `reservations` WHERE `netid` = ?", netid).Scan(&count)
+	err = t.db.QueryRowContext(context.Background(), "SELECT COUNT(`uid`) FROM `reservations` WHERE "+where, args...).Scan(&count)
 	if err != nil {
 		return ReservationResponse{Count: 0, Result: nil}, err
 	}
-	rows, err := t.conn.QueryContext(context.Background(), "SELECT `uid`, `date`, `site`, `preferences`, `priority`, `status_code`, `msg`, `court_time` FROM `reservations` WHERE `netid` = ? ORDER BY `created_at` DESC LIMIT ? OFFSET ?", netid, params.Limit, offset)
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `uid`, `netid`, `date`, `site`, `preferences`, `priority`, `status_code`, `msg`, `court_time` FROM `reservations` WHERE "+where+" ORDER BY "+order_by+" LIMIT ? OFFSET ?", append(args, params.Limit, offset)...)
 	if err != nil {
 		return ReservationResponse{Count: 0, Result: nil}, err
 	}
+	defer rows.Close()
 	ans := make([]ReservationResult, 0)
 	for rows.Next() {
 		var uid int64
+		var netid string
 		var date string
 		var site court_reserver_interface.Site
 		var preferences string
 		var priority int
 		var status court_reserver_interface.ReservationStatus
 		var court_time_string string
-		err = rows.Scan(&uid, &date, &site, &preferences, &priority, &status.Code, &status.Msg, &court_time_string)
+		err = rows.Scan(&uid, &netid, &date, &site, &preferences, &priority, &status.Code, &status.Msg, &court_time_string)
 		if err != nil {
 			return ReservationResponse{Count: 0, Result: nil}, err
 		}
@@ -531,7 +835,8 @@ func (t *SessionManager) GetReservations(params *GetReservationsParams) (Reserva
 			return ReservationResponse{Count: 0, Result: nil}, err
 		}
 		reservationStatus := ReservationResult{
-			Uid: uid,
+			Uid:   uid,
+			NetId: netid,
 			Reservation: ReservationCompatible{
 				Date:        date,
 				Site:        site,
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoginUpgradesLegacyPasswd(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	_, err := db.Exec("UPDATE `accounts` SET `passwd` = 'plain' WHERE `user` = 'foo'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Login(&LoginParams{User: "foo", Passwd: "wrong"}); err == nil {
+		t.Fatal("wrong passwd accepted")
+	}
+	testLogin(t, s, "foo", "plain")
+	var stored string
+	db.QueryRow("SELECT `passwd` FROM `accounts` WHERE `user` = 'foo'").Scan(&stored)
+	if !isPasswdHash(stored) {
+		t.Fatal("legacy passwd not upgraded")
+	}
+	testLogin(t, s, "foo", "plain")
+}
+
+// a statement run while another request is in a transaction must not become
+// part of it
+func TestWithTxIsolation(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	done := make(chan struct{})
+	rollback := errors.New("rollback")
+	err := s.withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE `accounts` SET `netid` = 'rolled back' WHERE `user` = 'foo'")
+		if err != nil {
+			return err
+		}
+		go func() {
+			s.audit(1, 1, AuditLogin, "concurrent", "", "")
+			close(done)
+		}()
+		// give the audit a chance to run inside this transaction, as it did
+		// on a shared connection
+		time.Sleep(100 * time.Millisecond)
+		return rollback
+	})
+	if err != rollback {
+		t.Fatal(err)
+	}
+	<-done
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM `audit_log` WHERE `detail` = 'concurrent'").Scan(&n)
+	if n != 1 {
+		t.Fatal("statement outside the transaction was rolled back with it")
+	}
+	db.QueryRow("SELECT COUNT(*) FROM `accounts` WHERE `netid` = 'rolled back'").Scan(&n)
+	if n != 0 {
+		t.Fatal("transaction not rolled back")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	AuditLogin              = "login"
+	AuditLoginFailed        = "login_failed"
+	AuditSignOut            = "sign_out"
+	AuditPasswdChange       = "passwd_change"
+	AuditNetIdPasswdChange  = "netid_passwd_change"
+	AuditPasswdReset        = "passwd_reset"
+	AuditPasswdResetRequest = "passwd_reset_request"
+	AuditEmailChange        = "email_change"
+	AuditDelegationGranted  = "delegation_granted"
+	AuditDelegationRevoked  = "delegation_revoked"
+	AuditAccountDeleted     = "account_deleted"
+	AuditAccountDisabled    = "account_disabled"
+	AuditAccountEnabled     = "account_enabled"
+	AuditReservationPlaced  = "reservation_placed"
+	AuditReservationCancel  = "reservation_cancelled"
+	AuditReservationEdited  = "reservation_edited"
+)
+
+// record an action on account by actor, which differs from account when an
+// admin acts on someone else's account. 0 stands for an unknown account.
+// Failing to write the log does not fail the action; it is only reported.
+func (t *SessionManager) audit(account int64, actor int64, action string, detail string, client_ip string, user_agent string) {
+	_, err := t.db.ExecContext(context.Background(), "INSERT INTO `audit_log` (`account`, `actor`, `action`, `detail`, `ip`, `user_agent`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, ?)", account, actor, action, detail, client_ip, user_agent, time.Now().UTC())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR Audit SQL] %s %s %s\n", time.Now().Format(time.RFC3339), action, err.Error())
+	}
+}
+
+// record the outcome of a login attempt as user, whose account may not exist
+func (t *SessionManager) auditLogin(user string, method string, err error, client_ip string, user_agent string) {
+	var uid int64 = 0
+	if account, lookup_err := getAccountByUser(t.db, user); lookup_err == nil {
+		uid = account.Uid
+	}
+	if err != nil {
+		t.audit(uid, uid, AuditLoginFailed, fmt.Sprintf("%s %s: %s", method, user, err.Error()), client_ip, user_agent)
+		return
+	}
+	t.audit(uid, uid, AuditLogin, method, client_ip, user_agent)
+}
+
+type AuditEntry struct {
+	Uid       int64
+	Account   int64
+	Actor     int64
+	Action    string
+	Detail    string
+	Ip        string
+	UserAgent string
+	CreatedAt time.Time
+}
+
+type AuditResponse struct {
+	Count  uint
+	Result []AuditEntry
+}
+
+// account and action are left out of the filter when 0 / empty
+func (t *SessionManager) queryAudit(account int64, action string, page uint, limit uint) (AuditResponse, error) {
+	filter := "(? = 0 OR `account` = ?) AND (? = '' OR `action` = ?)"
+	args := []any{account, account, action, action}
+	var count uint
+	err := t.db.QueryRowContext(context.Background(), "SELECT COUNT(`uid`) FROM `audit_log` WHERE "+filter, args...).Scan(&count)
+	if err != nil {
+		return AuditResponse{Count: 0, Result: nil}, err
+	}
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `uid`, `account`, `actor`, `action`, `detail`, `ip`, `user_agent`, `created_at` FROM `audit_log` WHERE "+filter+" ORDER BY `uid` DESC LIMIT ? OFFSET ?", append(args, limit, page*limit)...)
+	if err != nil {
+		return AuditResponse{Count: 0, Result: nil}, err
+	}
+	defer rows.Close()
+	ans := make([]AuditEntry, 0)
+	for rows.Next() {
+		var entry AuditEntry
+		err = rows.Scan(&entry.Uid, &entry.Account, &entry.Actor, &entry.Action, &entry.Detail, &entry.Ip, &entry.UserAgent, &entry.CreatedAt)
+		if err != nil {
+			return AuditResponse{Count: 0, Result: nil}, err
+		}
+		ans = append(ans, entry)
+	}
+	return AuditResponse{Count: count, Result: ans}, rows.Err()
+}
+
+type GetAuditLogParams struct {
+	Session SessionId
+	Page    uint
+	Limit   uint
+}
+
+// entries about the caller's own account
+func (t *SessionManager) GetAuditLog(params *GetAuditLogParams) (AuditResponse, error) {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return AuditResponse{Count: 0, Result: nil}, err
+	}
+	return t.queryAudit(account.Uid, "", params.Page, params.Limit)
+}
+
+type AdminGetAuditLogParams struct {
+	Session SessionId
+	// 0 for every account
+	Account int64
+	// empty for every action
+	Action string
+	Page   uint
+	Limit  uint
+}
+
+func (t *SessionManager) AdminGetAuditLog(params *AdminGetAuditLogParams) (AuditResponse, error) {
+	_, err := t.getAdminSession(params.Session)
+	if err != nil {
+		return AuditResponse{Count: 0, Result: nil}, err
+	}
+	return t.queryAudit(params.Account, params.Action, params.Page, params.Limit)
+}
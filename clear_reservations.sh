@@ -1,3 +1,2 @@
 #!/bin/bash
-rm xjtutennis.db
-sqlite3 xjtutennis.db < create_table.sql
\ No newline at end of file
+sqlite3 xjtutennis.db "DELETE FROM \`reservations\`;"
\ No newline at end of file
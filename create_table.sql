@@ -1,7 +1,9 @@
 CREATE TABLE `reservations` (
     `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL DEFAULT 0,
     `netid` TEXT NOT NULL,
-    `passwd` TEXT NOT NULL,
+    -- no longer used, credentials are looked up by account and netid
+    `passwd` TEXT NOT NULL DEFAULT '',
     `date` TEXT NOT NULL,
     `site` INTEGER NOT NULL,
     `preferences` TEXT NOT NULL,
@@ -10,5 +12,165 @@ CREATE TABLE `reservations` (
     `status_code` INTEGER NOT NULL DEFAULT 0,
     `msg` TEXT NOT NULL DEFAULT '',
     `court_time` TEXT NOT NULL DEFAULT '{}',
+    `picked_up` BOOLEAN NOT NULL DEFAULT 0,
+    -- the rule that placed it, 0 if placed by hand
+    `rule` INTEGER NOT NULL DEFAULT 0,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX `reservations_account_created_at` ON `reservations` (`account`, `created_at`);
+CREATE INDEX `reservations_account_date` ON `reservations` (`account`, `date`);
+CREATE INDEX `reservations_account_reserve_on` ON `reservations` (`account`, `reserve_on`);
+CREATE INDEX `reservations_account_status` ON `reservations` (`account`, `status_code`, `date`);
+CREATE INDEX `reservations_status_reserve_on` ON `reservations` (`status_code`, `reserve_on`);
+CREATE INDEX `reservations_rule_date` ON `reservations` (`rule`, `date`);
+CREATE TABLE `accounts` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `user` TEXT NOT NULL UNIQUE,
+    `passwd` TEXT NOT NULL,
+    `netid` TEXT NOT NULL,
+    `netid_passwd` TEXT NOT NULL,
+    `admin` BOOLEAN NOT NULL DEFAULT 0,
+    `disabled` BOOLEAN NOT NULL DEFAULT 0,
+    `email` TEXT NOT NULL DEFAULT '',
+    -- NetID and passwd fingerprints of the user_data.csv line the account was
+    -- last synced from, empty for accounts that did not come from the file
+    `imported_record` TEXT NOT NULL DEFAULT '',
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE `sessions` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `token_hash` TEXT NOT NULL UNIQUE,
+    `account` INTEGER NOT NULL,
+    `expiry` TIMESTAMP NOT NULL,
+    `last_seen` TIMESTAMP NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `ip` TEXT NOT NULL DEFAULT '',
+    `user_agent` TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX `sessions_expiry` ON `sessions` (`expiry`);
+CREATE TABLE `login_failures` (
+    `kind` TEXT NOT NULL,
+    `key` TEXT NOT NULL,
+    `failures` INTEGER NOT NULL DEFAULT 0,
+    `locked_until` TIMESTAMP,
+    `updated_at` TIMESTAMP NOT NULL,
+    PRIMARY KEY (`kind`, `key`)
+);
+CREATE TABLE `totp` (
+    `account` INTEGER PRIMARY KEY,
+    `secret` TEXT NOT NULL,
+    `enabled` INTEGER NOT NULL DEFAULT 0,
+    `last_step` INTEGER NOT NULL DEFAULT 0,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE `totp_recovery_codes` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `code_hash` TEXT NOT NULL,
+    `used` INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX `totp_recovery_codes_account` ON `totp_recovery_codes` (`account`);
+CREATE TABLE `api_tokens` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `name` TEXT NOT NULL,
+    `token_hash` TEXT NOT NULL UNIQUE,
+    `scope` TEXT NOT NULL,
+    `last_used` TIMESTAMP,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE `netids` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `label` TEXT NOT NULL DEFAULT '',
+    `netid` TEXT NOT NULL,
+    `passwd` TEXT NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (`account`, `netid`)
+);
+CREATE TABLE `invite_codes` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `code_hash` TEXT NOT NULL UNIQUE,
+    `max_uses` INTEGER NOT NULL,
+    `uses` INTEGER NOT NULL DEFAULT 0,
+    `expiry` TIMESTAMP NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE `audit_log` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `actor` INTEGER NOT NULL,
+    `action` TEXT NOT NULL,
+    `detail` TEXT NOT NULL DEFAULT '',
+    `ip` TEXT NOT NULL DEFAULT '',
+    `user_agent` TEXT NOT NULL DEFAULT '',
     `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX `audit_log_account` ON `audit_log` (`account`);
+CREATE TRIGGER `audit_log_no_update` BEFORE UPDATE ON `audit_log`
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+CREATE TRIGGER `audit_log_no_delete` BEFORE DELETE ON `audit_log`
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+CREATE TABLE `passwd_resets` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `token_hash` TEXT NOT NULL UNIQUE,
+    `expiry` TIMESTAMP NOT NULL,
+    `used` BOOLEAN NOT NULL DEFAULT 0,
+    `created_at` TIMESTAMP NOT NULL
+);
+CREATE TABLE `delegations` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `owner` INTEGER NOT NULL,
+    `delegate` INTEGER NOT NULL,
+    `rights` TEXT NOT NULL,
+    `expiry` TIMESTAMP NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (`owner`, `delegate`)
+);
+CREATE INDEX `delegations_delegate` ON `delegations` (`delegate`);
+CREATE TABLE `reservation_events` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `reservation` INTEGER NOT NULL,
+    `source` TEXT NOT NULL,
+    `status_code` INTEGER NOT NULL,
+    `msg` TEXT NOT NULL DEFAULT '',
+    `court_time` TEXT NOT NULL DEFAULT '{}',
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX `reservation_events_reservation` ON `reservation_events` (`reservation`);
+CREATE TABLE `reservation_rules` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `netid` TEXT NOT NULL,
+    -- bit n set for time.Weekday n
+    `weekdays` INTEGER NOT NULL,
+    `site` INTEGER NOT NULL,
+    `preferences` TEXT NOT NULL,
+    `priority` INTEGER NOT NULL,
+    `start_date` TEXT NOT NULL,
+    `end_date` TEXT NOT NULL DEFAULT '',
+    -- last date reservations have been placed for
+    `generated_until` TEXT NOT NULL DEFAULT '',
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX `reservation_rules_account` ON `reservation_rules` (`account`);
+CREATE TABLE `reservation_templates` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `name` TEXT NOT NULL,
+    `site` INTEGER NOT NULL,
+    `preferences` TEXT NOT NULL,
+    `priority` INTEGER NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (`account`, `name`)
+);
+-- users who deleted their account, skipped when importing user_data.csv
+CREATE TABLE `deleted_accounts` (
+    `user` TEXT PRIMARY KEY,
+    `deleted_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
\ No newline at end of file
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	DelegationView   = "view"
+	DelegationManage = "manage"
+)
+
+// the account whose reservations a request acts on: the caller's own when
+// target is empty, or target's if it granted the caller a delegation that
+// covers the request.
+func (t *SessionManager) resolveTarget(caller *Account, target string, manage bool) (*Account, error) {
+	if target == "" || target == caller.User {
+		return caller, nil
+	}
+	owner, err := getAccountByUser(t.db, target)
+	if _, ok := err.(TennisApiError); ok {
+		return nil, TennisApiError{errorType: PermissionDenied}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rights string
+	err = t.db.QueryRowContext(context.Background(), "SELECT `rights` FROM `delegations` WHERE `owner` = ? AND `delegate` = ? AND `expiry` > ?", owner.Uid, caller.Uid, time.Now().UTC()).Scan(&rights)
+	if err == sql.ErrNoRows {
+		return nil, TennisApiError{errorType: PermissionDenied}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if owner.Disabled || (manage && rights != DelegationManage) {
+		return nil, TennisApiError{errorType: PermissionDenied}
+	}
+	return owner, nil
+}
+
+type DelegationInfo struct {
+	Uid      int64
+	Owner    string
+	Delegate string
+	Rights   string
+	Expiry   time.Time
+}
+
+type DelegationsResponse struct {
+	// delegations the caller has granted
+	Granted []DelegationInfo
+	// delegations granted to the caller
+	Received []DelegationInfo
+}
+
+func (t *SessionManager) queryDelegations(column string, uid int64) ([]DelegationInfo, error) {
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `delegations`.`uid`, `owners`.`user`, `delegates`.`user`, `rights`, `expiry` FROM `delegations` JOIN `accounts` AS `owners` ON `owners`.`uid` = `owner` JOIN `accounts` AS `delegates` ON `delegates`.`uid` = `delegate` WHERE `"+column+"` = ? AND `expiry` > ? ORDER BY `expiry` ASC", uid, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ans := make([]DelegationInfo, 0)
+	for rows.Next() {
+		var info DelegationInfo
+		err = rows.Scan(&info.Uid, &info.Owner, &info.Delegate, &info.Rights, &info.Expiry)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, info)
+	}
+	return ans, rows.Err()
+}
+
+func (t *SessionManager) ListDelegations(params *SessionOnlyParams) (DelegationsResponse, error) {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return DelegationsResponse{}, err
+	}
+	granted, err := t.queryDelegations("owner", account.Uid)
+	if err != nil {
+		return DelegationsResponse{}, err
+	}
+	received, err := t.queryDelegations("delegate", account.Uid)
+	if err != nil {
+		return DelegationsResponse{}, err
+	}
+	return DelegationsResponse{Granted: granted, Received: received}, nil
+}
+
+type GrantDelegationParams struct {
+	Session  SessionId
+	Delegate string
+	Rights   string
+	// e.g. "168h"
+	Expiry    string
+	ClientIp  string
+	UserAgent string
+}
+
+// let another account view or manage the caller's reservations until the
+// expiry. Granting again to the same account replaces the delegation.
+func (t *SessionManager) GrantDelegation(params *GrantDelegationParams) (int64, error) {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return -1, err
+	}
+	if params.Rights != DelegationView && params.Rights != DelegationManage {
+		return -1, TennisApiError{errorType: MalformedData, message: "Rights must be \"view\" or \"manage\""}
+	}
+	expiry, err := time.ParseDuration(params.Expiry)
+	if err != nil || expiry <= 0 {
+		return -1, TennisApiError{errorType: MalformedData, message: "Invalid expiry"}
+	}
+	delegate, err := getAccountByUser(t.db, params.Delegate)
+	if err != nil {
+		return -1, err
+	}
+	if delegate.Uid == account.Uid {
+		return -1, TennisApiError{errorType: InvalidQuery, message: "Cannot delegate to yourself"}
+	}
+	var uid int64
+	err = t.db.QueryRowContext(context.Background(), "INSERT INTO `delegations` (`owner`, `delegate`, `rights`, `expiry`) VALUES (?, ?, ?, ?) ON CONFLICT (`owner`, `delegate`) DO UPDATE SET `rights` = excluded.`rights`, `expiry` = excluded.`expiry` RETURNING `uid`", account.Uid, delegate.Uid, params.Rights, time.Now().UTC().Add(expiry)).Scan(&uid)
+	if err != nil {
+		return -1, err
+	}
+	t.audit(account.Uid, account.Uid, AuditDelegationGranted, params.Rights+" to "+delegate.User, params.ClientIp, params.UserAgent)
+	return uid, nil
+}
+
+type RevokeDelegationParams struct {
+	Session   SessionId
+	Uid       int64
+	ClientIp  string
+	UserAgent string
+}
+
+// either side of a delegation can end it
+func (t *SessionManager) RevokeDelegation(params *RevokeDelegationParams) error {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return err
+	}
+	var owner int64
+	err = t.db.QueryRowContext(context.Background(), "DELETE FROM `delegations` WHERE `uid` = ? AND (`owner` = ? OR `delegate` = ?) RETURNING `owner`", params.Uid, account.Uid, account.Uid).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return TennisApiError{errorType: InvalidQuery, message: "No matching delegation"}
+	}
+	if err != nil {
+		return err
+	}
+	t.audit(owner, account.Uid, AuditDelegationRevoked, "", params.ClientIp, params.UserAgent)
+	return nil
+}
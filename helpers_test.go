@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// a session manager on a fresh database holding the accounts
+// foo/pw (NetID 3124) and bar/pw2 (NetID 3125)
+func newTestSessionManager(t *testing.T) (*sql.DB, *SessionManager) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := openDatabase(filepath.Join(dir, "xjtutennis.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	schema, err := os.ReadFile("create_table.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(string(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := NewSecretBox(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts_file := filepath.Join(dir, "user_data.csv")
+	err = os.WriteFile(accounts_file, []byte("foo,pw,3124,netpw\nbar,pw2,3125,netpw2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ImportAccounts(db, secrets, accounts_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSessionManager(db, secrets, SessionManagerConfig{LoginThrottle: LoginThrottleConfig{AccountMaxFailures: 3, IpMaxFailures: 10, Lockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, s
+}
+
+func testLogin(t *testing.T, s *SessionManager, user string, passwd string) SessionId {
+	t.Helper()
+	res, err := s.Login(&LoginParams{User: user, Passwd: passwd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, ok := res.(SessionId)
+	if !ok {
+		t.Fatalf("login of %s did not return a session: %v", user, res)
+	}
+	return session
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// legacy account file, one `user,passwd,netid,netid_passwd` record per line.
+// Fields containing commas, quotes or newlines are quoted as in RFC 4180.
+const user_data_file = "user_data.csv"
+
+type ParseError struct{}
+
+func (t ParseError) Error() string {
+	return "Error: ParseError"
+}
+
+// drop the records of users who deleted their account
+func skipDeletedAccounts(ctx context.Context, db *sql.DB, records []Account, path string) ([]Account, error) {
+	deleted := make(map[string]bool)
+	rows, err := db.QueryContext(ctx, "SELECT `user` FROM `deleted_accounts`")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user string
+		err = rows.Scan(&user)
+		if err != nil {
+			return nil, err
+		}
+		deleted[user] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	ans := make([]Account, 0, len(records))
+	for _, record := range records {
+		if deleted[record.User] {
+			fmt.Printf("[Info] %s Skipped account %s in %s, which was deleted by its user.\n", time.Now().Format(time.RFC3339), record.User, path)
+			continue
+		}
+		ans = append(ans, record)
+	}
+	return ans, nil
+}
+
+func readAccounts(path string) ([]Account, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 4
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	accounts := make([]Account, 0, len(records))
+	seen := make(map[string]bool)
+	for _, fields := range records {
+		if fields[0] == "" || seen[fields[0]] {
+			return nil, ParseError{}
+		}
+		seen[fields[0]] = true
+		account := Account{
+			User:        fields[0],
+			Passwd:      fields[1],
+			NetId:       fields[2],
+			NetIdPasswd: fields[3],
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+// what accounts.imported_record keeps of a user_data.csv record, to tell
+// later which of its fields were edited in the file since. Passwds are only
+// kept as fingerprints.
+type importedRecord struct {
+	NetId       string
+	Passwd      string
+	NetIdPasswd string
+}
+
+func fingerprintAccount(secrets *SecretBox, account *Account) importedRecord {
+	return importedRecord{
+		NetId:       account.NetId,
+		Passwd:      secrets.Fingerprint(account.Passwd),
+		NetIdPasswd: secrets.Fingerprint(account.NetIdPasswd),
+	}
+}
+
+func encodeImportedRecord(record *importedRecord) (string, error) {
+	var buf strings.Builder
+	writer := csv.NewWriter(&buf)
+	err := writer.Write([]string{record.NetId, record.Passwd, record.NetIdPasswd})
+	if err != nil {
+		return "", err
+	}
+	writer.Flush()
+	return buf.String(), writer.Error()
+}
+
+func decodeImportedRecord(record string) (*importedRecord, error) {
+	reader := csv.NewReader(strings.NewReader(record))
+	reader.FieldsPerRecord = 3
+	fields, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	return &importedRecord{NetId: fields[0], Passwd: fields[1], NetIdPasswd: fields[2]}, nil
+}
+
+// passwds in the file may already be hashed
+func hashImportedPasswd(passwd string) (string, error) {
+	if isPasswdHash(passwd) {
+		return passwd, nil
+	}
+	return hashPasswd(passwd)
+}
+
+// an accounts row ready to be written: passwd hashed, NetID passwd sealed
+type importedAccount struct {
+	Account
+	record string
+}
+
+func prepareImportedAccount(secrets *SecretBox, account *Account) (importedAccount, error) {
+	var err error
+	ans := importedAccount{Account: *account}
+	ans.Passwd, err = hashImportedPasswd(account.Passwd)
+	if err != nil {
+		return importedAccount{}, err
+	}
+	ans.NetIdPasswd, err = secrets.Reseal(account.NetIdPasswd)
+	if err != nil {
+		return importedAccount{}, err
+	}
+	record := fingerprintAccount(secrets, account)
+	ans.record, err = encodeImportedRecord(&record)
+	if err != nil {
+		return importedAccount{}, err
+	}
+	return ans, nil
+}
+
+func insertImportedAccount(ctx context.Context, tx *sql.Tx, account *importedAccount) (int64, error) {
+	res, err := tx.ExecContext(ctx, "INSERT INTO `accounts` (`user`, `passwd`, `netid`, `netid_passwd`, `imported_record`) VALUES (?, ?, ?, ?, ?) ON CONFLICT (`user`) DO NOTHING", account.User, account.Passwd, account.NetId, account.NetIdPasswd, account.record)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// copy the accounts of a user_data.csv into the accounts table, hashing
+// passwds and sealing NetID passwds on the way. Users already present in the
+// table, or who deleted their account, are left alone. Reservations that
+// predate accounts are handed to the account owning their NetID. Returns the
+// number of accounts created.
+func ImportAccounts(db *sql.DB, secrets *SecretBox, path string) (int, error) {
+	records, err := readAccounts(path)
+	if err != nil {
+		return 0, err
+	}
+	records, err = skipDeletedAccounts(context.Background(), db, records, path)
+	if err != nil {
+		return 0, err
+	}
+	accounts := make([]importedAccount, 0, len(records))
+	for i := range records {
+		account, err := prepareImportedAccount(secrets, &records[i])
+		if err != nil {
+			return 0, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	for i := range accounts {
+		n, err := insertImportedAccount(ctx, tx, &accounts[i])
+		if err != nil {
+			return 0, err
+		}
+		imported += int(n)
+	}
+	err = adoptLegacyReservations(tx)
+	if err != nil {
+		return 0, err
+	}
+	return imported, tx.Commit()
+}
+
+type AccountSyncResult struct {
+	Added    int
+	Updated  int
+	Disabled int
+}
+
+type accountUpdate struct {
+	uid     int64
+	user    string
+	columns []string
+	values  []interface{}
+}
+
+func (t *accountUpdate) set(column string, value interface{}) {
+	t.columns = append(t.columns, column)
+	t.values = append(t.values, value)
+}
+
+// bring the accounts table in line with a user_data.csv in one transaction.
+// Accounts new in the file are created. For accounts imported before, the
+// fields edited in the file since are written, so a passwd changed through
+// the API survives until its line in the file changes. Accounts imported
+// before and no longer in the file are disabled and signed out. Accounts that
+// never came from the file are left alone, unless the file names them, in
+// which case their current values are kept and they are tracked from then on.
+// Users who deleted their account are skipped.
+func SyncAccounts(db *sql.DB, secrets *SecretBox, path string) (AccountSyncResult, error) {
+	records, err := readAccounts(path)
+	if err != nil {
+		return AccountSyncResult{}, err
+	}
+	ctx := context.Background()
+	records, err = skipDeletedAccounts(ctx, db, records, path)
+	if err != nil {
+		return AccountSyncResult{}, err
+	}
+	type storedAccount struct {
+		uid      int64
+		disabled bool
+		// nil for accounts that did not come from the file
+		record *importedRecord
+	}
+	stored := make(map[string]storedAccount)
+	rows, err := db.QueryContext(ctx, "SELECT `uid`, `user`, `disabled`, `imported_record` FROM `accounts`")
+	if err != nil {
+		return AccountSyncResult{}, err
+	}
+	for rows.Next() {
+		var account storedAccount
+		var user, record string
+		err = rows.Scan(&account.uid, &user, &account.disabled, &record)
+		if err != nil {
+			rows.Close()
+			return AccountSyncResult{}, err
+		}
+		if record != "" {
+			account.record, err = decodeImportedRecord(record)
+			if err != nil {
+				rows.Close()
+				return AccountSyncResult{}, err
+			}
+		}
+		stored[user] = account
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return AccountSyncResult{}, err
+	}
+
+	// hash and seal outside the transaction, as bcrypt is slow, and only what
+	// was edited in the file
+	added := make([]importedAccount, 0)
+	updates := make([]accountUpdate, 0)
+	in_file := make(map[string]bool)
+	for i := range records {
+		record := &records[i]
+		in_file[record.User] = true
+		previous, ok := stored[record.User]
+		if !ok {
+			account, err := prepareImportedAccount(secrets, record)
+			if err != nil {
+				return AccountSyncResult{}, err
+			}
+			added = append(added, account)
+			continue
+		}
+		fingerprint := fingerprintAccount(secrets, record)
+		update := accountUpdate{uid: previous.uid, user: record.User}
+		if previous.record == nil {
+			if previous.disabled {
+				fmt.Printf("[Info] %s Account %s in %s is disabled; enable it through the admin API.\n", time.Now().Format(time.RFC3339), record.User, path)
+			}
+		} else if *previous.record == fingerprint {
+			continue
+		} else {
+			if previous.record.Passwd != fingerprint.Passwd {
+				passwd, err := hashImportedPasswd(record.Passwd)
+				if err != nil {
+					return AccountSyncResult{}, err
+				}
+				update.set("passwd", passwd)
+			}
+			if previous.record.NetId != fingerprint.NetId {
+				update.set("netid", record.NetId)
+			}
+			if previous.record.NetIdPasswd != fingerprint.NetIdPasswd {
+				netid_passwd, err := secrets.Reseal(record.NetIdPasswd)
+				if err != nil {
+					return AccountSyncResult{}, err
+				}
+				update.set("netid_passwd", netid_passwd)
+			}
+		}
+		encoded, err := encodeImportedRecord(&fingerprint)
+		if err != nil {
+			return AccountSyncResult{}, err
+		}
+		update.set("imported_record", encoded)
+		updates = append(updates, update)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return AccountSyncResult{}, err
+	}
+	defer tx.Rollback()
+
+	var result AccountSyncResult
+	for i := range added {
+		n, err := insertImportedAccount(ctx, tx, &added[i])
+		if err != nil {
+			return AccountSyncResult{}, err
+		}
+		if n == 0 {
+			return AccountSyncResult{}, fmt.Errorf("account %s was created during the reload", added[i].User)
+		}
+		result.Added++
+		fmt.Printf("[Info] %s Added account %s from %s.\n", time.Now().Format(time.RFC3339), added[i].User, path)
+	}
+	for _, update := range updates {
+		assignments := make([]string, 0, len(update.columns))
+		for _, column := range update.columns {
+			assignments = append(assignments, "`"+column+"` = ?")
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE `accounts` SET "+strings.Join(assignments, ", ")+" WHERE `uid` = ?", append(update.values, update.uid)...)
+		if err != nil {
+			return AccountSyncResult{}, err
+		}
+		changed := update.columns[:len(update.columns)-1]
+		if len(changed) > 0 {
+			result.Updated++
+			fmt.Printf("[Info] %s Updated %s of account %s from %s.\n", time.Now().Format(time.RFC3339), strings.Join(changed, ", "), update.user, path)
+		}
+	}
+	for user, account := range stored {
+		if in_file[user] || account.record == nil {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE `accounts` SET `disabled` = 1, `imported_record` = '' WHERE `uid` = ?", account.uid)
+		if err != nil {
+			return AccountSyncResult{}, err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM `sessions` WHERE `account` = ?", account.uid)
+		if err != nil {
+			return AccountSyncResult{}, err
+		}
+		result.Disabled++
+		fmt.Printf("[Info] %s Disabled account %s, which is no longer in %s.\n", time.Now().Format(time.RFC3339), user, path)
+	}
+	err = adoptLegacyReservations(tx)
+	if err != nil {
+		return AccountSyncResult{}, err
+	}
+	return result, tx.Commit()
+}
+
+// reservations placed before accounts existed were only keyed by NetID, and
+// migration 007 can only match those whose account had been imported already.
+// Give the rest to the account with that primary NetID.
+func adoptLegacyReservations(tx *sql.Tx) error {
+	res, err := tx.ExecContext(context.Background(), "UPDATE `reservations` SET `account` = (SELECT `uid` FROM `accounts` WHERE `accounts`.`netid` = `reservations`.`netid` ORDER BY `uid` ASC LIMIT 1) WHERE `account` = 0 AND EXISTS (SELECT 1 FROM `accounts` WHERE `accounts`.`netid` = `reservations`.`netid`)")
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		fmt.Printf("[Info] %s Attached %d reservations without an account to their NetID's account.\n", time.Now().Format(time.RFC3339), n)
+	}
+	return nil
+}
+
+// sync the accounts table with path whenever the server receives SIGHUP, so
+// that edits to the file take effect without a restart. The file is only
+// read, and one that fails to parse is rejected as a whole. Sessions of
+// accounts that remain are kept.
+func ReloadAccountsOnSignal(db *sql.DB, secrets *SecretBox, path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		result, err := SyncAccounts(db, secrets, path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR Account RELOAD] %s %s %s\n", time.Now().Format(time.RFC3339), path, err.Error())
+			continue
+		}
+		fmt.Printf("[Info] %s Reloaded %s, %d accounts added, %d updated, %d disabled.\n", time.Now().Format(time.RFC3339), path, result.Added, result.Updated, result.Disabled)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportAdoptsLegacyReservations(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	res, err := db.Exec("INSERT INTO `reservations` (`netid`, `date`, `site`, `preferences`, `priority`, `reserve_on`) VALUES ('3126', '2099-01-01', 1, '[]', 1, '2098-12-29')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, _ := res.LastInsertId()
+	path := filepath.Join(t.TempDir(), "user_data.csv")
+	err = os.WriteFile(path, []byte("foo,pw,3124,netpw\nbar,pw2,3125,netpw2\nbaz,pw3,3126,netpw3\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ImportAccounts(db, s.secrets, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var account, baz int64
+	db.QueryRow("SELECT `account` FROM `reservations` WHERE `uid` = ?", uid).Scan(&account)
+	db.QueryRow("SELECT `uid` FROM `accounts` WHERE `user` = 'baz'").Scan(&baz)
+	if account == 0 || account != baz {
+		t.Fatalf("reservation belongs to %d, want %d", account, baz)
+	}
+}
+
+func TestSyncAccounts(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	foo := testLogin(t, s, "foo", "pw")
+	bar := testLogin(t, s, "bar", "pw2")
+	// changed through the API; an unedited line must not revert it
+	err := s.ChangePasswd(&ChangePasswdParams{Session: foo, OldPasswd: "pw", NewPasswd: "new-pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not from the file, so never disabled by a sync
+	_, err = db.Exec("INSERT INTO `accounts` (`user`, `passwd`, `netid`, `netid_passwd`) VALUES ('invited', '', '3127', 'x')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "user_data.csv")
+	sync := func(data string) AccountSyncResult {
+		t.Helper()
+		err := os.WriteFile(path, []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := SyncAccounts(db, s.secrets, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := sync("foo,pw,3124,netpw\nbar,pw2,3135,netpw2\nbaz,pw3,3126,netpw3\n")
+	if result != (AccountSyncResult{Added: 1, Updated: 1}) {
+		t.Fatalf("%+v", result)
+	}
+	testLogin(t, s, "foo", "new-pw")
+	testLogin(t, s, "baz", "pw3")
+	// only fingerprints of the passwds are kept
+	var record string
+	db.QueryRow("SELECT `imported_record` FROM `accounts` WHERE `user` = 'baz'").Scan(&record)
+	if record == "" || strings.Contains(record, "pw3") || strings.Contains(record, "netpw3") || isSealedSecret(record) {
+		t.Fatalf("imported record %q", record)
+	}
+	if account, err := s.GetLoginAccount(&SessionOnlyParams{Session: bar}); err != nil || account.NetId != "3135" {
+		t.Fatalf("bar: %+v %v", account, err)
+	}
+
+	result = sync("foo,changed,3124,netpw\nbaz,pw3,3126,netpw3\n")
+	if result != (AccountSyncResult{Updated: 1, Disabled: 1}) {
+		t.Fatalf("%+v", result)
+	}
+	testLogin(t, s, "foo", "changed")
+	if _, err := s.GetLoginAccount(&SessionOnlyParams{Session: bar}); err == nil {
+		t.Fatal("bar is still signed in")
+	}
+	var disabled bool
+	db.QueryRow("SELECT `disabled` FROM `accounts` WHERE `user` = 'invited'").Scan(&disabled)
+	if disabled {
+		t.Fatal("account not from the file was disabled")
+	}
+
+	// a file that fails to parse changes nothing
+	err = os.WriteFile(path, []byte("foo,pw\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SyncAccounts(db, s.secrets, path); err == nil {
+		t.Fatal("malformed file accepted")
+	}
+	testLogin(t, s, "foo", "changed")
+}
+
+func TestSyncSkipsDeletedAccounts(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	foo := testLogin(t, s, "foo", "pw")
+	err := s.DeleteAccount(&DeleteAccountParams{Session: foo, Passwd: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "user_data.csv")
+	err = os.WriteFile(path, []byte("foo,pw,3124,netpw\nbar,pw2,3125,netpw2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := SyncAccounts(db, s.secrets, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (AccountSyncResult{}) {
+		t.Fatalf("%+v", result)
+	}
+	if n, err := ImportAccounts(db, s.secrets, path); err != nil || n != 0 {
+		t.Fatalf("imported %d, %v", n, err)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM `accounts` WHERE `user` = 'foo'").Scan(&n)
+	if n != 0 {
+		t.Fatal("deleted account came back")
+	}
+}
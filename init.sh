@@ -1,3 +1,5 @@
 #!/bin/bash
-touch user_data.csv
+if [ ! -f master.key ]; then
+    (umask 077 && head -c 32 /dev/urandom | base64 > master.key)
+fi
 sqlite3 xjtutennis.db < create_table.sql
\ No newline at end of file
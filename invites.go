@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"time"
+)
+
+func newInviteCode() string {
+	rand_bytes := make([]byte, 16)
+	_, err := rand.Read(rand_bytes)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(rand_bytes)
+}
+
+// create an invite code that can register max_uses accounts until it expires.
+// Like session ids, only the hash of the code is stored.
+func MintInviteCode(db execer, max_uses int, expiry time.Duration) (string, error) {
+	if max_uses <= 0 {
+		return "", TennisApiError{errorType: MalformedData, message: "An invite code must allow at least one use"}
+	}
+	code := newInviteCode()
+	_, err := db.ExecContext(context.Background(), "INSERT INTO `invite_codes` (`code_hash`, `max_uses`, `expiry`) VALUES (?, ?, ?)", hashSessionId(SessionId(code)), max_uses, time.Now().UTC().Add(expiry))
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// use up one registration of code
+func useInviteCode(tx *sql.Tx, code string) error {
+	res, err := tx.ExecContext(context.Background(), "UPDATE `invite_codes` SET `uses` = `uses` + 1 WHERE `code_hash` = ? AND `uses` < `max_uses` AND `expiry` > ?", hashSessionId(SessionId(code)), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return TennisApiError{errorType: InvalidQuery, message: "Invalid or expired invite code"}
+	}
+	return nil
+}
+
+type RegisterParams struct {
+	InviteCode  string
+	User        string
+	Passwd      string
+	NetId       string
+	NetIdPasswd string
+	ClientIp    string
+	UserAgent   string
+}
+
+// create an account with an invite code, and sign it in
+func (t *SessionManager) Register(params *RegisterParams) (SessionId, error) {
+	account, err := t.prepareAccount(params.User, params.Passwd, params.NetId, params.NetIdPasswd)
+	if err != nil {
+		return "", err
+	}
+	var uid int64
+	err = t.withTx(func(tx *sql.Tx) error {
+		err := useInviteCode(tx, params.InviteCode)
+		if err != nil {
+			return err
+		}
+		uid, err = insertAccount(tx, account)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return t.newSession(uid, params.ClientIp, params.UserAgent)
+}
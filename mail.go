@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const smtp_passwd_env = "XJTUTENNIS_SMTP_PASSWD"
+
+type MailConfig struct {
+	// host:port of the SMTP server, mail is disabled if empty
+	Addr   string
+	User   string
+	Passwd string
+	From   string
+}
+
+func (t *MailConfig) enabled() bool {
+	return t.Addr != ""
+}
+
+// send a plain text mail. Without a user, no authentication is attempted,
+// e.g. for a local relay or test sink.
+func (t *MailConfig) send(to string, subject string, body string) error {
+	var auth smtp.Auth = nil
+	if t.User != "" {
+		host := t.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", t.User, t.Passwd, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n", t.From, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(t.Addr, auth, t.From, []string{to}, []byte(msg))
+}
@@ -14,6 +14,14 @@ import (
 
 const http_port = 25571
 
+// requests share a pool of connections to path. WAL lets them read while one
+// of them writes, writers wait for each other for up to 5s instead of failing
+// with "database is locked", and transactions take the write lock as they
+// begin, so that two of them never deadlock upgrading their read locks.
+func openDatabase(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
+}
+
 func usage(program string) {
 	fmt.Fprintf(os.Stderr, "usage: %s captcha_url\n", program)
 	os.Exit(2)
@@ -23,9 +31,35 @@ type mainArgs struct {
 }
 
 func main() {
-	var reserver_plugin_path, challenge_url string
+	var reserver_plugin_path, challenge_url, master_key_file, rekey_file, import_file string
 	flag.StringVar(&reserver_plugin_path, "reserver-plugin", "", "If provided, choose the reserver plugin of XJTUTennis")
 	flag.StringVar(&challenge_url, "challenge-url", "", "Must be given if reserverPlugin is given")
+	flag.StringVar(&master_key_file, "master-key-file", "master.key", "File holding the base64 master key encrypting NetID passwords. $"+master_key_env+" takes precedence")
+	flag.StringVar(&rekey_file, "rekey", "", "If provided, re-encrypt all NetID passwords under the key in this file and exit")
+	flag.StringVar(&import_file, "import-accounts", "", "If provided, import the accounts of this user_data.csv into the database and exit")
+	var accounts_file string
+	flag.StringVar(&accounts_file, "accounts-file", "", "If provided, sync accounts with this user_data.csv whenever the server receives SIGHUP: add new ones, apply edits and disable removed ones")
+	var grant_admin string
+	flag.StringVar(&grant_admin, "grant-admin", "", "If provided, make this user an admin and exit")
+	var mint_invite int
+	var invite_expiry time.Duration
+	flag.IntVar(&mint_invite, "mint-invite", 0, "If provided, print a new invite code that registers up to this many accounts and exit")
+	flag.DurationVar(&invite_expiry, "invite-expiry", 7*24*time.Hour, "Validity of the code printed by -mint-invite")
+	var sso_whitelist_file string
+	flag.StringVar(&sso_whitelist_file, "sso-whitelist", "", "If provided, NetIDs listed in this file get an account on their first SSO login")
+	var config SessionManagerConfig
+	var passwd_blocklist_file string
+	flag.StringVar(&config.Mail.Addr, "smtp-addr", "", "If provided, host:port of the SMTP server passwd reset mails are sent through")
+	flag.StringVar(&config.Mail.User, "smtp-user", "", "SMTP user, the password is read from $"+smtp_passwd_env)
+	flag.StringVar(&config.Mail.From, "smtp-from", "", "Sender address of passwd reset mails")
+	flag.IntVar(&config.PasswdPolicy.MinLength, "passwd-min-length", 8, "Minimum length of new passwords")
+	flag.IntVar(&config.PasswdPolicy.MinClasses, "passwd-min-classes", 1, "Minimum number of character classes (lowercase, uppercase, digits, symbols) in new passwords")
+	flag.StringVar(&passwd_blocklist_file, "passwd-blocklist", "", "If provided, refuse new passwords listed in this file, one per line")
+	flag.IntVar(&config.LoginThrottle.AccountMaxFailures, "login-account-max-failures", 5, "Failed logins to an account before it is locked")
+	flag.IntVar(&config.LoginThrottle.IpMaxFailures, "login-ip-max-failures", 20, "Failed logins from an IP before it is locked")
+	flag.DurationVar(&config.LoginThrottle.Lockout, "login-lockout", time.Minute, "Duration of the first login lockout, doubled on every further failure")
+	flag.DurationVar(&config.LoginThrottle.MaxLockout, "login-max-lockout", time.Hour, "Longest login lockout")
+	flag.DurationVar(&config.LoginThrottle.Window, "login-failure-window", 24*time.Hour, "Failed logins are forgotten after this long without another one")
 
 	flag.Parse()
 
@@ -43,31 +77,104 @@ func main() {
 		}
 	}
 
-	db, err := sql.Open("sqlite3", "xjtutennis.db")
+	master_key, err := LoadMasterKey(master_key_file)
 	if err != nil {
-		panic("db creation failed")
+		panic(fmt.Sprintf("Cannot load master key: %s", err.Error()))
+	}
+	secrets, err := NewSecretBox(master_key)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid master key: %s", err.Error()))
 	}
-	conn_session, err := db.Conn(context.Background())
+
+	db, err := openDatabase("xjtutennis.db")
 	if err != nil {
-		panic("db connection failed")
+		panic("db creation failed")
+	}
+
+	if rekey_file != "" {
+		new_master_key, err := ReadMasterKeyFile(rekey_file)
+		if err != nil {
+			panic(fmt.Sprintf("Cannot load new master key: %s", err.Error()))
+		}
+		new_secrets, err := NewSecretBox(new_master_key)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid new master key: %s", err.Error()))
+		}
+		err = Rekey(db, secrets, new_secrets)
+		if err != nil {
+			panic(fmt.Sprintf("Rekey failed: %s", err.Error()))
+		}
+		fmt.Printf("[Info] %s All NetID passwords are now encrypted under %s. Replace the old master key with it before restarting.\n", time.Now().Format(time.RFC3339), rekey_file)
+		return
+	}
+	if import_file != "" {
+		imported, err := ImportAccounts(db, secrets, import_file)
+		if err != nil {
+			panic(fmt.Sprintf("Import failed: %s", err.Error()))
+		}
+		fmt.Printf("[Info] %s Imported %d accounts from %s.\n", time.Now().Format(time.RFC3339), imported, import_file)
+		return
+	}
+
+	if grant_admin != "" {
+		err := GrantAdmin(db, grant_admin)
+		if err != nil {
+			panic(fmt.Sprintf("Cannot grant admin: %s", err.Error()))
+		}
+		fmt.Printf("[Info] %s %s is now an admin.\n", time.Now().Format(time.RFC3339), grant_admin)
+		return
+	}
+	if mint_invite > 0 {
+		code, err := MintInviteCode(db, mint_invite, invite_expiry)
+		if err != nil {
+			panic(fmt.Sprintf("Cannot mint invite code: %s", err.Error()))
+		}
+		fmt.Printf("[Info] %s Invite code for %d accounts, valid until %s:\n%s\n", time.Now().Format(time.RFC3339), mint_invite, time.Now().Add(invite_expiry).Format(time.RFC3339), code)
+		return
+	}
+
+	config.Mail.Passwd = os.Getenv(smtp_passwd_env)
+	if config.Mail.Addr != "" && config.Mail.From == "" {
+		fmt.Fprintln(os.Stderr, "If an SMTP server is given, the sender must be given by -smtp-from.")
+		flag.Usage()
+		os.Exit(1)
 	}
+	if passwd_blocklist_file != "" {
+		config.PasswdPolicy.Blocklist, err = ReadPasswdBlocklist(passwd_blocklist_file)
+		if err != nil {
+			panic(fmt.Sprintf("Cannot load password blocklist: %s", err.Error()))
+		}
+	}
+	if sso_whitelist_file != "" {
+		config.SsoWhitelist, err = ReadSsoWhitelist(sso_whitelist_file)
+		if err != nil {
+			panic(fmt.Sprintf("Cannot load SSO whitelist: %s", err.Error()))
+		}
+	}
+
 	var solver captcha_solver.CaptchaSolver = nil
 
 	if court_reserver != nil {
 		solver = court_reserver.NewCaptchaSolver(challenge_url)
 	}
 
-	session_mgr, err := NewSessionManager(conn_session, solver, court_reserver)
+	session_mgr, err := NewSessionManager(db, secrets, config, solver, court_reserver)
 	if err != nil {
 		panic("session manager creation failed")
 	}
 
+	go session_mgr.ReapSessions()
+	go session_mgr.GenerateRuleReservations()
+	if accounts_file != "" {
+		go ReloadAccountsOnSignal(db, secrets, accounts_file)
+	}
+
 	if court_reserver != nil {
 		conn_reserver, err := db.Conn(context.Background())
 		if err != nil {
 			panic("db connection failed")
 		}
-		reserver := NewReservationHandler(conn_reserver, solver, court_reserver)
+		reserver := NewReservationHandler(conn_reserver, secrets, solver, court_reserver)
 		go reserver.MainEvent()
 	} else {
 		fmt.Printf("[Info] %s The program is running without a reserver. You can still place reservations, but none of them will be served.\n", time.Now().Format(time.RFC3339))
@@ -0,0 +1,8 @@
+CREATE TABLE `accounts` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `user` TEXT NOT NULL UNIQUE,
+    `passwd` TEXT NOT NULL,
+    `netid` TEXT NOT NULL,
+    `netid_passwd` TEXT NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,9 @@
+CREATE TABLE `sessions` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `token_hash` TEXT NOT NULL UNIQUE,
+    `account` INTEGER NOT NULL,
+    `expiry` TIMESTAMP NOT NULL,
+    `last_seen` TIMESTAMP NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX `sessions_expiry` ON `sessions` (`expiry`);
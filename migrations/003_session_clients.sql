@@ -0,0 +1,2 @@
+ALTER TABLE `sessions` ADD COLUMN `ip` TEXT NOT NULL DEFAULT '';
+ALTER TABLE `sessions` ADD COLUMN `user_agent` TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+CREATE TABLE `login_failures` (
+    `kind` TEXT NOT NULL,
+    `key` TEXT NOT NULL,
+    `failures` INTEGER NOT NULL DEFAULT 0,
+    `locked_until` TIMESTAMP,
+    `updated_at` TIMESTAMP NOT NULL,
+    PRIMARY KEY (`kind`, `key`)
+);
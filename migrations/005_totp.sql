@@ -0,0 +1,14 @@
+CREATE TABLE `totp` (
+    `account` INTEGER PRIMARY KEY,
+    `secret` TEXT NOT NULL,
+    `enabled` INTEGER NOT NULL DEFAULT 0,
+    `last_step` INTEGER NOT NULL DEFAULT 0,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE `totp_recovery_codes` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `code_hash` TEXT NOT NULL,
+    `used` INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX `totp_recovery_codes_account` ON `totp_recovery_codes` (`account`);
@@ -0,0 +1,9 @@
+CREATE TABLE `api_tokens` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `name` TEXT NOT NULL,
+    `token_hash` TEXT NOT NULL UNIQUE,
+    `scope` TEXT NOT NULL,
+    `last_used` TIMESTAMP,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
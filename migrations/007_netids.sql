@@ -0,0 +1,14 @@
+CREATE TABLE `netids` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `label` TEXT NOT NULL DEFAULT '',
+    `netid` TEXT NOT NULL,
+    `passwd` TEXT NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (`account`, `netid`)
+);
+ALTER TABLE `reservations` ADD COLUMN `account` INTEGER NOT NULL DEFAULT 0;
+-- reservations whose NetID has no account yet keep 0 here; -import-accounts
+-- attaches them once their account is imported
+UPDATE `reservations` SET `account` = COALESCE((SELECT `uid` FROM `accounts` WHERE `accounts`.`netid` = `reservations`.`netid`), 0);
+CREATE INDEX `reservations_account` ON `reservations` (`account`);
@@ -0,0 +1,8 @@
+CREATE TABLE `invite_codes` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `code_hash` TEXT NOT NULL UNIQUE,
+    `max_uses` INTEGER NOT NULL,
+    `uses` INTEGER NOT NULL DEFAULT 0,
+    `expiry` TIMESTAMP NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
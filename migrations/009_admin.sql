@@ -0,0 +1,2 @@
+ALTER TABLE `accounts` ADD COLUMN `admin` BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE `accounts` ADD COLUMN `disabled` BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,19 @@
+CREATE TABLE `audit_log` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `actor` INTEGER NOT NULL,
+    `action` TEXT NOT NULL,
+    `detail` TEXT NOT NULL DEFAULT '',
+    `ip` TEXT NOT NULL DEFAULT '',
+    `user_agent` TEXT NOT NULL DEFAULT '',
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX `audit_log_account` ON `audit_log` (`account`);
+CREATE TRIGGER `audit_log_no_update` BEFORE UPDATE ON `audit_log`
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+CREATE TRIGGER `audit_log_no_delete` BEFORE DELETE ON `audit_log`
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
@@ -0,0 +1,9 @@
+ALTER TABLE `accounts` ADD COLUMN `email` TEXT NOT NULL DEFAULT '';
+CREATE TABLE `passwd_resets` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `token_hash` TEXT NOT NULL UNIQUE,
+    `expiry` TIMESTAMP NOT NULL,
+    `used` BOOLEAN NOT NULL DEFAULT 0,
+    `created_at` TIMESTAMP NOT NULL
+);
@@ -0,0 +1,10 @@
+CREATE TABLE `delegations` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `owner` INTEGER NOT NULL,
+    `delegate` INTEGER NOT NULL,
+    `rights` TEXT NOT NULL,
+    `expiry` TIMESTAMP NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (`owner`, `delegate`)
+);
+CREATE INDEX `delegations_delegate` ON `delegations` (`delegate`);
@@ -0,0 +1,2 @@
+UPDATE `reservations` SET `passwd` = '';
+VACUUM;
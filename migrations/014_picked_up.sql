@@ -0,0 +1 @@
+ALTER TABLE `reservations` ADD COLUMN `picked_up` BOOLEAN NOT NULL DEFAULT 0;
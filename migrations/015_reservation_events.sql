@@ -0,0 +1,10 @@
+CREATE TABLE `reservation_events` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `reservation` INTEGER NOT NULL,
+    `source` TEXT NOT NULL,
+    `status_code` INTEGER NOT NULL,
+    `msg` TEXT NOT NULL DEFAULT '',
+    `court_time` TEXT NOT NULL DEFAULT '{}',
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX `reservation_events_reservation` ON `reservation_events` (`reservation`);
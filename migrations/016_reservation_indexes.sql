@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS `reservations_account`;
+CREATE INDEX `reservations_account_created_at` ON `reservations` (`account`, `created_at`);
+CREATE INDEX `reservations_account_date` ON `reservations` (`account`, `date`);
+CREATE INDEX `reservations_account_reserve_on` ON `reservations` (`account`, `reserve_on`);
+CREATE INDEX `reservations_account_status` ON `reservations` (`account`, `status_code`, `date`);
+CREATE INDEX `reservations_status_reserve_on` ON `reservations` (`status_code`, `reserve_on`);
@@ -0,0 +1,18 @@
+CREATE TABLE `reservation_rules` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `netid` TEXT NOT NULL,
+    -- bit n set for time.Weekday n
+    `weekdays` INTEGER NOT NULL,
+    `site` INTEGER NOT NULL,
+    `preferences` TEXT NOT NULL,
+    `priority` INTEGER NOT NULL,
+    `start_date` TEXT NOT NULL,
+    `end_date` TEXT NOT NULL DEFAULT '',
+    -- last date reservations have been placed for
+    `generated_until` TEXT NOT NULL DEFAULT '',
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX `reservation_rules_account` ON `reservation_rules` (`account`);
+ALTER TABLE `reservations` ADD COLUMN `rule` INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX `reservations_rule_date` ON `reservations` (`rule`, `date`);
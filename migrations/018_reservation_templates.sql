@@ -0,0 +1,10 @@
+CREATE TABLE `reservation_templates` (
+    `uid` INTEGER PRIMARY KEY AUTOINCREMENT,
+    `account` INTEGER NOT NULL,
+    `name` TEXT NOT NULL,
+    `site` INTEGER NOT NULL,
+    `preferences` TEXT NOT NULL,
+    `priority` INTEGER NOT NULL,
+    `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (`account`, `name`)
+);
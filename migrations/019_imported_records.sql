@@ -0,0 +1,4 @@
+-- accounts imported before this are tracked from the first reload that
+-- finds them in user_data.csv; until then removing them from the file has no
+-- effect
+ALTER TABLE `accounts` ADD COLUMN `imported_record` TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- history left behind by cancelled reservations
+DELETE FROM `reservation_events` WHERE `reservation` NOT IN (SELECT `uid` FROM `reservations`);
@@ -0,0 +1,6 @@
+-- users who deleted their account, so that reloading user_data.csv does not
+-- create it again
+CREATE TABLE `deleted_accounts` (
+    `user` TEXT PRIMARY KEY,
+    `deleted_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
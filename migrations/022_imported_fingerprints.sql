@@ -0,0 +1,4 @@
+-- imported records used to be sealed copies of the whole user_data.csv line,
+-- passwd included. Drop them; the next reload keeps the current values of the
+-- accounts in the file and stores fingerprints from then on.
+UPDATE `accounts` SET `imported_record` = '' WHERE `imported_record` != '';
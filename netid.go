@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/endaytrer/court_reserver_interface"
+	"github.com/endaytrer/xjtuorg"
+)
+
+// try logging in to the reserver with the given NetID credentials, as
+// wakeUp would.
+func (t *SessionManager) checkNetIdLogin(netid string, passwd string) error {
+	if t.reserverPlugin == nil {
+		return TennisApiError{errorType: ReserverUnavailable, message: "NetID credentials can only be checked with a reserver plugin"}
+	}
+	login_session := xjtuorg.New(true)
+	_, err := login_session.Login(t.reserverPlugin.LoginURL, netid, passwd)
+	if err != nil {
+		return TennisApiError{errorType: NetIdLoginFailed, message: err.Error()}
+	}
+	return nil
+}
+
+// NetID passwds are set by the university, so anything goes as long as
+// there is one
+func checkNetIdPasswd(passwd string) error {
+	if passwd == "" {
+		return TennisApiError{errorType: InvalidPasswd, message: "NetID passwd must not be empty"}
+	}
+	return nil
+}
+
+// the sealed passwd of netid as currently registered by account, so that
+// bookings always use the latest one
+func lookupNetIdPasswd(db queryRower, account int64, netid string) (string, error) {
+	var passwd string
+	err := db.QueryRowContext(context.Background(), "SELECT `netid_passwd` FROM `accounts` WHERE `uid` = ? AND `netid` = ? UNION ALL SELECT `passwd` FROM `netids` WHERE `account` = ? AND `netid` = ? LIMIT 1", account, netid, account, netid).Scan(&passwd)
+	if err == sql.ErrNoRows {
+		return "", TennisApiError{errorType: InvalidQuery, message: "No credentials for NetID " + netid}
+	}
+	return passwd, err
+}
+
+// find the credentials of netid among those registered by account. An empty
+// netid selects the account's primary NetID. Returns the sealed passwd.
+func resolveNetId(db queryRower, account *Account, netid string) (string, string, error) {
+	if netid == "" || netid == account.NetId {
+		return account.NetId, account.NetIdPasswd, nil
+	}
+	var passwd string
+	err := db.QueryRowContext(context.Background(), "SELECT `passwd` FROM `netids` WHERE `account` = ? AND `netid` = ?", account.Uid, netid).Scan(&passwd)
+	if err == sql.ErrNoRows {
+		return "", "", TennisApiError{errorType: InvalidQuery, message: "Unknown NetID"}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return netid, passwd, nil
+}
+
+type NetIdVerification struct {
+	NetId string
+	Valid bool
+	Msg   string
+}
+
+type VerifyNetIdParams struct {
+	Session SessionId
+	// empty for the primary NetID
+	NetId string
+}
+
+// report whether the stored NetID credentials currently work
+func (t *SessionManager) VerifyNetId(params *VerifyNetIdParams) (NetIdVerification, error) {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return NetIdVerification{}, err
+	}
+	netid, sealed, err := resolveNetId(t.db, account, params.NetId)
+	if err != nil {
+		return NetIdVerification{}, err
+	}
+	passwd, err := t.secrets.Open(sealed)
+	if err != nil {
+		return NetIdVerification{}, err
+	}
+	err = t.checkNetIdLogin(netid, passwd)
+	if api_err, ok := err.(TennisApiError); ok && api_err.errorType == NetIdLoginFailed {
+		return NetIdVerification{NetId: netid, Valid: false, Msg: api_err.message}, nil
+	}
+	if err != nil {
+		return NetIdVerification{}, err
+	}
+	return NetIdVerification{NetId: netid, Valid: true, Msg: ""}, nil
+}
+
+type NetIdInfo struct {
+	// 0 for the primary NetID
+	Uid     int64
+	Label   string
+	NetId   string
+	Primary bool
+}
+
+func (t *SessionManager) ListNetIds(params *SessionOnlyParams) ([]NetIdInfo, error) {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return nil, err
+	}
+	ans := []NetIdInfo{{Uid: 0, Label: "", NetId: account.NetId, Primary: true}}
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `uid`, `label`, `netid` FROM `netids` WHERE `account` = ? ORDER BY `uid` ASC", account.Uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var info NetIdInfo
+		err = rows.Scan(&info.Uid, &info.Label, &info.NetId)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, info)
+	}
+	return ans, rows.Err()
+}
+
+type AddNetIdParams struct {
+	Session SessionId
+	Label   string
+	NetId   string
+	Passwd  string
+}
+
+// register an additional NetID, e.g. a partner's, to book with
+func (t *SessionManager) AddNetId(params *AddNetIdParams) (int64, error) {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return -1, err
+	}
+	if params.NetId == "" || params.NetId == account.NetId {
+		return -1, TennisApiError{errorType: InvalidQuery, message: "NetID already registered"}
+	}
+	err = checkNetIdPasswd(params.Passwd)
+	if err != nil {
+		return -1, err
+	}
+	if t.reserverPlugin != nil {
+		err = t.checkNetIdLogin(params.NetId, params.Passwd)
+		if err != nil {
+			return -1, err
+		}
+	}
+	sealed, err := t.secrets.Seal(params.Passwd)
+	if err != nil {
+		return -1, err
+	}
+	res, err := t.db.ExecContext(context.Background(), "INSERT INTO `netids` (`account`, `label`, `netid`, `passwd`) VALUES (?, ?, ?, ?) ON CONFLICT (`account`, `netid`) DO NOTHING", account.Uid, params.Label, params.NetId, sealed)
+	if err != nil {
+		return -1, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	if n == 0 {
+		return -1, TennisApiError{errorType: InvalidQuery, message: "NetID already registered"}
+	}
+	return res.LastInsertId()
+}
+
+type ChangeExtraNetIdPasswdParams struct {
+	Session   SessionId
+	Uid       int64
+	NewPasswd string
+}
+
+func (t *SessionManager) ChangeExtraNetIdPasswd(params *ChangeExtraNetIdPasswdParams) error {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return err
+	}
+	err = checkNetIdPasswd(params.NewPasswd)
+	if err != nil {
+		return err
+	}
+	var netid string
+	err = t.db.QueryRowContext(context.Background(), "SELECT `netid` FROM `netids` WHERE `account` = ? AND `uid` = ?", account.Uid, params.Uid).Scan(&netid)
+	if err == sql.ErrNoRows {
+		return TennisApiError{errorType: InvalidQuery, message: "Unknown NetID"}
+	}
+	if err != nil {
+		return err
+	}
+	if t.reserverPlugin != nil {
+		err = t.checkNetIdLogin(netid, params.NewPasswd)
+		if err != nil {
+			return err
+		}
+	}
+	sealed, err := t.secrets.Seal(params.NewPasswd)
+	if err != nil {
+		return err
+	}
+	_, err = t.db.ExecContext(context.Background(), "UPDATE `netids` SET `passwd` = ? WHERE `account` = ? AND `uid` = ?", sealed, account.Uid, params.Uid)
+	return err
+}
+
+type RemoveNetIdParams struct {
+	Session SessionId
+	Uid     int64
+}
+
+// NetIDs still selected by pending reservations or rules cannot be removed
+func (t *SessionManager) RemoveNetId(params *RemoveNetIdParams) error {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return err
+	}
+	return t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		var netid string
+		err := tx.QueryRowContext(ctx, "SELECT `netid` FROM `netids` WHERE `account` = ? AND `uid` = ?", account.Uid, params.Uid).Scan(&netid)
+		if err == sql.ErrNoRows {
+			return TennisApiError{errorType: InvalidQuery, message: "Unknown NetID"}
+		}
+		if err != nil {
+			return err
+		}
+		var pending int
+		err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(`uid`) FROM `reservations` WHERE `account` = ? AND `netid` = ? AND `status_code` = %d", int(court_reserver_interface.Pending)), account.Uid, netid).Scan(&pending)
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			return TennisApiError{errorType: InvalidQuery, message: fmt.Sprintf("NetID is used by %d pending reservations", pending)}
+		}
+		var rules int
+		err = tx.QueryRowContext(ctx, "SELECT COUNT(`uid`) FROM `reservation_rules` WHERE `account` = ? AND `netid` = ?", account.Uid, netid).Scan(&rules)
+		if err != nil {
+			return err
+		}
+		if rules > 0 {
+			return TennisApiError{errorType: InvalidQuery, message: fmt.Sprintf("NetID is used by %d reservation rules", rules)}
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM `netids` WHERE `account` = ? AND `uid` = ?", account.Uid, params.Uid)
+		return err
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwd_hash_cost = 12
+
+// bcrypt does not look at anything past the 72nd byte
+const passwd_max_len = 72
+
+// bcrypt hashes start with "$2a$", "$2b$" or "$2y$". Anything else found in
+// the accounts table is a legacy plaintext passwd.
+func isPasswdHash(passwd string) bool {
+	return strings.HasPrefix(passwd, "$2a$") ||
+		strings.HasPrefix(passwd, "$2b$") ||
+		strings.HasPrefix(passwd, "$2y$")
+}
+
+func hashPasswd(passwd string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), passwd_hash_cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// compare passwd against a stored hash, or against a legacy plaintext passwd
+// in constant time.
+func verifyPasswd(stored string, passwd string) bool {
+	if isPasswdHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(passwd)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(passwd)) == 1
+}
+
+type PasswdPolicy struct {
+	MinLength int
+	// how many of lowercase letters, uppercase letters, digits and other
+	// characters a passwd has to mix
+	MinClasses int
+	// lowercase passwds that are too common to be allowed
+	Blocklist map[string]bool
+}
+
+// one lowercase passwd per line, empty lines are ignored
+func ReadPasswdBlocklist(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blocklist := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			blocklist[strings.ToLower(line)] = true
+		}
+	}
+	return blocklist, nil
+}
+
+func passwdClasses(passwd string) int {
+	var lower, upper, digit, other bool
+	for _, c := range passwd {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes += 1
+		}
+	}
+	return classes
+}
+
+// check a new site passwd for user, explaining what is wrong with it
+func (t *PasswdPolicy) check(user string, passwd string) error {
+	if len(passwd) > passwd_max_len {
+		return TennisApiError{errorType: InvalidPasswd, message: fmt.Sprintf("must be at most %d bytes long", passwd_max_len)}
+	}
+	if utf8.RuneCountInString(passwd) < t.MinLength {
+		return TennisApiError{errorType: InvalidPasswd, message: fmt.Sprintf("must be at least %d characters long", t.MinLength)}
+	}
+	if passwdClasses(passwd) < t.MinClasses {
+		return TennisApiError{errorType: InvalidPasswd, message: fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", t.MinClasses)}
+	}
+	if t.Blocklist[strings.ToLower(passwd)] || (user != "" && strings.EqualFold(passwd, user)) {
+		return TennisApiError{errorType: InvalidPasswd, message: "too common or easy to guess"}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// re-encrypt every sealed secret (NetID passwds in the accounts and netids
+// tables, TOTP secrets) under new_secrets. The server should be stopped, as
+// anything it seals meanwhile would still use the old key.
+func Rekey(db *sql.DB, old_secrets *SecretBox, new_secrets *SecretBox) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = rekeyColumn(ctx, tx, old_secrets, new_secrets, "accounts", "uid", "netid_passwd")
+	if err != nil {
+		return err
+	}
+	// fingerprints cannot be carried over to the new key. Forget them; the next
+	// reload of user_data.csv tracks the accounts in it again, keeping their
+	// current values.
+	_, err = tx.ExecContext(ctx, "UPDATE `accounts` SET `imported_record` = '' WHERE `imported_record` != ''")
+	if err != nil {
+		return err
+	}
+	err = rekeyColumn(ctx, tx, old_secrets, new_secrets, "netids", "uid", "passwd")
+	if err != nil {
+		return err
+	}
+	err = rekeyColumn(ctx, tx, old_secrets, new_secrets, "totp", "account", "secret")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func rekeyColumn(ctx context.Context, tx *sql.Tx, old_secrets *SecretBox, new_secrets *SecretBox, table string, key_column string, column string) error {
+	rows, err := tx.QueryContext(ctx, "SELECT `"+key_column+"`, `"+column+"` FROM `"+table+"`")
+	if err != nil {
+		return err
+	}
+	secrets := make(map[int64]string)
+	for rows.Next() {
+		var key int64
+		var secret string
+		err = rows.Scan(&key, &secret)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		secrets[key] = secret
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for key, secret := range secrets {
+		// nothing to seal, and sealing it would make it look set
+		if secret == "" {
+			continue
+		}
+		plaintext, err := old_secrets.Open(secret)
+		if err != nil {
+			return err
+		}
+		sealed, err := new_secrets.Seal(plaintext)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE `"+table+"` SET `"+column+"` = ? WHERE `"+key_column+"` = ?", sealed, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
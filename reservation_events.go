@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/endaytrer/court_reserver_interface"
+)
+
+// who caused a status transition of a reservation
+const (
+	EventSourceScheduler = "scheduler"
+	EventSourceImmediate = "immediate"
+	EventSourceUser      = "user"
+)
+
+type ReservationEvent struct {
+	Reservation int64
+	Source      string
+	Status      court_reserver_interface.ReservationStatus
+	CreatedAt   time.Time
+}
+
+func recordReservationEvent(db execer, uid int64, source string, status court_reserver_interface.ReservationStatus) error {
+	court_time := status.CourtTime
+	if court_time == nil {
+		court_time = make(map[string]string)
+	}
+	encoded, err := json.Marshal(court_time)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(context.Background(), "INSERT INTO `reservation_events` (`reservation`, `source`, `status_code`, `msg`, `court_time`, `created_at`) VALUES (?, ?, ?, ?, ?, ?)", uid, source, status.Code, status.Msg, string(encoded), time.Now().UTC())
+	return err
+}
+
+// the history of the given reservations, oldest first
+func (t *SessionManager) queryReservationEvents(where string, args ...any) ([]ReservationEvent, error) {
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `reservation`, `source`, `status_code`, `msg`, `court_time`, `created_at` FROM `reservation_events` WHERE "+where+" ORDER BY `uid` ASC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ans := make([]ReservationEvent, 0)
+	for rows.Next() {
+		var event ReservationEvent
+		var court_time string
+		err = rows.Scan(&event.Reservation, &event.Source, &event.Status.Code, &event.Status.Msg, &court_time, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(court_time), &event.Status.CourtTime)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, event)
+	}
+	return ans, rows.Err()
+}
+
+type GetReservationParams struct {
+	Session SessionId
+	Uid     int64
+	// user whose reservation to show through a delegation, empty for oneself
+	Target string
+}
+
+type ReservationDetail struct {
+	ReservationResult
+	// the day the scheduler books it, and the booking window on that day
+	ReserveOn    string
+	BookingStart time.Time
+	BookingEnd   time.Time
+	PickedUp     bool
+	CreatedAt    time.Time
+	Events       []ReservationEvent
+}
+
+func (t *SessionManager) GetReservation(params *GetReservationParams) (ReservationDetail, error) {
+	caller, err := t.getSession(params.Session)
+	if err != nil {
+		return ReservationDetail{}, err
+	}
+	account, err := t.resolveTarget(caller, params.Target, false)
+	if err != nil {
+		return ReservationDetail{}, err
+	}
+	var detail ReservationDetail
+	var preferences, court_time string
+	err = t.db.QueryRowContext(context.Background(), "SELECT `uid`, `netid`, `date`, `site`, `preferences`, `priority`, `status_code`, `msg`, `court_time`, `reserve_on`, `picked_up`, `created_at` FROM `reservations` WHERE `account` = ? AND `uid` = ?", account.Uid, params.Uid).Scan(
+		&detail.Uid, &detail.NetId, &detail.Reservation.Date, &detail.Reservation.Site, &preferences, &detail.Reservation.Priority,
+		&detail.Status.Code, &detail.Status.Msg, &court_time, &detail.ReserveOn, &detail.PickedUp, &detail.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ReservationDetail{}, TennisApiError{errorType: InvalidQuery, message: "No matching reservation"}
+	}
+	if err != nil {
+		return ReservationDetail{}, err
+	}
+	err = json.Unmarshal([]byte(preferences), &detail.Reservation.Preferences)
+	if err != nil {
+		return ReservationDetail{}, err
+	}
+	err = json.Unmarshal([]byte(court_time), &detail.Status.CourtTime)
+	if err != nil {
+		return ReservationDetail{}, err
+	}
+	reserve_on, err := time.ParseInLocation(DATE_FORMAT, detail.ReserveOn, t.timeZone)
+	if err != nil {
+		return ReservationDetail{}, err
+	}
+	detail.BookingStart = reserve_on.Add(BOOKING_START)
+	detail.BookingEnd = reserve_on.Add(BOOKING_END)
+	detail.Events, err = t.queryReservationEvents("`reservation` = ?", detail.Uid)
+	if err != nil {
+		return ReservationDetail{}, err
+	}
+	return detail, nil
+}
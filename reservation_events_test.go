@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/endaytrer/court_reserver_interface"
+)
+
+func TestCancelDropsReservationEvents(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	session := testLogin(t, s, "foo", "pw")
+	uid, err := s.PlaceReservation(&PlaceReservationParams{Session: session, Reservation: ReservationCompatible{Date: "2099-01-01", Site: 1, Preferences: []SingleBookCompatible{}, Priority: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func() int {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM `reservation_events` WHERE `reservation` = ?", uid).Scan(&n)
+		return n
+	}
+	if count() == 0 {
+		t.Fatal("placing recorded no event")
+	}
+	err = s.CancelReservation(&CancelReservationParams{Session: session, Uid: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("%d events left behind", n)
+	}
+	// a booking that finishes after the cancel must not leave any either
+	err = UpdateReservation(s.db, uid, court_reserver_interface.ReservationStatus{Code: court_reserver_interface.Failed}, EventSourceScheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("%d events recorded for a cancelled reservation", n)
+	}
+}
@@ -16,18 +16,20 @@ import (
 // handle delayed reservation requests
 type ReservationHandler struct {
 	conn           *sql.Conn
+	secrets        *SecretBox
 	timeZone       *time.Location
 	captchaSolver  captcha_solver.CaptchaSolver
 	reserverPlugin *CourtReserverPlugin
 }
 
-func NewReservationHandler(conn *sql.Conn, captcha_solver captcha_solver.CaptchaSolver, reserver_plugin *CourtReserverPlugin) ReservationHandler {
+func NewReservationHandler(conn *sql.Conn, secrets *SecretBox, captcha_solver captcha_solver.CaptchaSolver, reserver_plugin *CourtReserverPlugin) ReservationHandler {
 	time_zone, err := time.LoadLocation("Asia/Shanghai")
 	if err != nil {
 		panic("Invalid time zone")
 	}
 	return ReservationHandler{
 		conn:           conn,
+		secrets:        secrets,
 		timeZone:       time_zone,
 		captchaSolver:  captcha_solver,
 		reserverPlugin: reserver_plugin,
@@ -39,9 +41,29 @@ const WAKEUP_MIN = 39
 const BOOKING_START = WAKEUP_HR*time.Hour + WAKEUP_MIN*time.Minute + 55*time.Second
 const BOOKING_END = 21*time.Hour + 39*time.Minute + 55*time.Second
 
+// reservations are booked in one CAS login per NetID of an account
+type reserverKey struct {
+	account int64
+	netid   string
+}
+
 func (t *ReservationHandler) wakeUp(date string) error {
-	// select reservations ready to be performed.
-	stmt, err := t.conn.PrepareContext(context.Background(), fmt.Sprintf("SELECT `uid`, `netid`, `passwd`, `date`, `site`, `preferences`, `priority` FROM `reservations` WHERE `status_code` = %d AND `reserve_on` = ? ORDER BY `priority` ASC", int(court_reserver_interface.Pending)))
+	// disabled accounts do not get their courts booked
+	_, err := t.conn.ExecContext(context.Background(), fmt.Sprintf("INSERT INTO `reservation_events` (`reservation`, `source`, `status_code`, `msg`, `court_time`, `created_at`) SELECT `uid`, ?, %d, 'Account disabled', '{}', ? FROM `reservations` WHERE `status_code` = %d AND `reserve_on` = ? AND `account` IN (SELECT `uid` FROM `accounts` WHERE `disabled` = 1)", int(court_reserver_interface.Failed), int(court_reserver_interface.Pending)), EventSourceScheduler, time.Now().UTC(), date)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.ExecContext(context.Background(), fmt.Sprintf("UPDATE `reservations` SET `status_code` = %d, `msg` = 'Account disabled' WHERE `status_code` = %d AND `reserve_on` = ? AND `account` IN (SELECT `uid` FROM `accounts` WHERE `disabled` = 1)", int(court_reserver_interface.Failed), int(court_reserver_interface.Pending)), date)
+	if err != nil {
+		return err
+	}
+	// pick up reservations ready to be performed, so they can no longer be
+	// edited, then select them.
+	_, err = t.conn.ExecContext(context.Background(), fmt.Sprintf("UPDATE `reservations` SET `picked_up` = 1 WHERE `status_code` = %d AND `reserve_on` = ?", int(court_reserver_interface.Pending)), date)
+	if err != nil {
+		return err
+	}
+	stmt, err := t.conn.PrepareContext(context.Background(), fmt.Sprintf("SELECT `uid`, `account`, `netid`, `date`, `site`, `preferences`, `priority` FROM `reservations` WHERE `status_code` = %d AND `reserve_on` = ? AND `picked_up` = 1 ORDER BY `priority` ASC", int(court_reserver_interface.Pending)))
 	if err != nil {
 		return err
 	}
@@ -49,20 +71,19 @@ func (t *ReservationHandler) wakeUp(date string) error {
 	if err != nil {
 		return err
 	}
-	reserver_info := make(map[string][]court_reserver_interface.Reservation)
-	reserver_uids := make(map[string][]int64)
-	reserver_passwds := make(map[string]string)
+	reserver_info := make(map[reserverKey][]court_reserver_interface.Reservation)
+	reserver_uids := make(map[reserverKey][]int64)
 
 	for rows.Next() {
 		var uid int64
+		var account int64
 		var netid string
-		var passwd string
 		var date_str string
 		var site court_reserver_interface.Site
 		var preferences string
 		var priority int
 
-		err = rows.Scan(&uid, &netid, &passwd, &date_str, &site, &preferences, &priority)
+		err = rows.Scan(&uid, &account, &netid, &date_str, &site, &preferences, &priority)
 		if err != nil {
 			return err
 		}
@@ -79,34 +100,46 @@ func (t *ReservationHandler) wakeUp(date string) error {
 		for _, book := range books {
 			books_internal = append(books_internal, book.convert())
 		}
-		if _, ok := reserver_info[netid]; !ok {
-			reserver_info[netid] = make([]court_reserver_interface.Reservation, 0)
-			reserver_uids[netid] = make([]int64, 0)
+		key := reserverKey{account: account, netid: netid}
+		if _, ok := reserver_info[key]; !ok {
+			reserver_info[key] = make([]court_reserver_interface.Reservation, 0)
+			reserver_uids[key] = make([]int64, 0)
 		}
-		reserver_passwds[netid] = passwd
-		reserver_info[netid] = append(reserver_info[netid], court_reserver_interface.Reservation{
+		reserver_info[key] = append(reserver_info[key], court_reserver_interface.Reservation{
 			Date:        date,
 			Site:        site,
 			Preferences: books_internal,
 			Priority:    priority,
 		})
-		reserver_uids[netid] = append(reserver_uids[netid], uid)
+		reserver_uids[key] = append(reserver_uids[key], uid)
 	}
-	for netid := range reserver_info {
-		fmt.Printf("[Info] Totally %d bookings found for today in account %s\n", len(reserver_info[netid]), netid)
+	rows.Close()
+	for key := range reserver_info {
+		netid := key.netid
+		fmt.Printf("[Info] Totally %d bookings found for today in account %s\n", len(reserver_info[key]), netid)
+		// the passwd the account has now, not when the reservations were placed
+		sealed_passwd, lookup_err := lookupNetIdPasswd(t.conn, key.account, netid)
 		go (func() {
-			login_session := xjtuorg.New(true)
-			redir, err := login_session.Login(t.reserverPlugin.LoginURL, netid, reserver_passwds[netid])
+			// only decrypt the NetID passwd right before logging in
+			var redir, passwd string
+			err := lookup_err
+			if err == nil {
+				passwd, err = t.secrets.Open(sealed_passwd)
+			}
+			if err == nil {
+				login_session := xjtuorg.New(true)
+				redir, err = login_session.Login(t.reserverPlugin.LoginURL, netid, passwd)
+			}
 
 			// cannot login, return all failed.
 			// reuse login
 			if err != nil {
-				for _, uid := range reserver_uids[netid] {
+				for _, uid := range reserver_uids[key] {
 					UpdateReservation(t.conn, uid, court_reserver_interface.ReservationStatus{
 						Code:      court_reserver_interface.Failed,
 						Msg:       fmt.Sprintf("Login Error: %s", err.Error()),
 						CourtTime: make(map[string]string),
-					})
+					}, EventSourceScheduler)
 				}
 				fmt.Fprintf(os.Stderr, "[ERROR Reserver LOGIN] %s %s", time.Now().Format(time.RFC3339), err.Error())
 				return
@@ -121,9 +154,9 @@ func (t *ReservationHandler) wakeUp(date string) error {
 				time.Sleep(1 * time.Second)
 			}
 
-			for i, reservation := range reserver_info[netid] {
+			for i, reservation := range reserver_info[key] {
 				result_status := reserver.BookNow(t.timeZone, &reservation, t.captchaSolver)
-				err := UpdateReservation(t.conn, reserver_uids[netid][i], result_status)
+				err := UpdateReservation(t.conn, reserver_uids[key][i], result_status, EventSourceScheduler)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "[ERROR Reserver SQL] %s %s", time.Now().Format(time.RFC3339), err.Error())
 					continue
@@ -134,21 +167,27 @@ func (t *ReservationHandler) wakeUp(date string) error {
 	}
 	return nil
 }
-func UpdateReservation(conn *sql.Conn, uid int64, status court_reserver_interface.ReservationStatus) error {
 
-	stmt, err := conn.PrepareContext(context.Background(), "UPDATE `reservations` SET `status_code` = ?, `msg` = ?, `court_time` = ? WHERE uid = ?")
+// set the status of reservation uid, and record the transition caused by
+// source in its history
+func UpdateReservation(db execer, uid int64, status court_reserver_interface.ReservationStatus, source string) error {
+	encoded, err := json.Marshal(status.CourtTime)
 	if err != nil {
 		return err
 	}
-	encoded, err := json.Marshal(status.CourtTime)
+	res, err := db.ExecContext(context.Background(), "UPDATE `reservations` SET `status_code` = ?, `msg` = ?, `court_time` = ? WHERE uid = ?", status.Code, status.Msg, string(encoded), uid)
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(status.Code, status.Msg, string(encoded), uid)
+	n, err := res.RowsAffected()
 	if err != nil {
 		return err
 	}
-	return nil
+	// cancelled while it was being booked; there is no history to add to
+	if n == 0 {
+		return nil
+	}
+	return recordReservationEvent(db, uid, source, status)
 }
 
 func (t *ReservationHandler) MainEvent() {
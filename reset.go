@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/mail"
+	"os"
+	"time"
+)
+
+const passwd_reset_expiry = time.Hour
+
+// at most one reset mail per account in this interval
+const passwd_reset_interval = time.Minute
+
+type ChangeEmailParams struct {
+	Session SessionId
+	// empty to remove the address
+	Email     string
+	Passwd    string
+	ClientIp  string
+	UserAgent string
+}
+
+// set the address reset tokens are sent to. As it decides who can reset the
+// passwd, the passwd is required.
+func (t *SessionManager) ChangeEmail(params *ChangeEmailParams) error {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return err
+	}
+	email := ""
+	if params.Email != "" {
+		address, err := mail.ParseAddress(params.Email)
+		if err != nil {
+			return TennisApiError{errorType: MalformedData, message: "Invalid email address"}
+		}
+		email = address.Address
+	}
+	err = t.throttleLogin(account.User, params.ClientIp, func() error {
+		if !verifyPasswd(account.Passwd, params.Passwd) {
+			return TennisApiError{errorType: WrongPasswd}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = t.db.ExecContext(context.Background(), "UPDATE `accounts` SET `email` = ? WHERE `uid` = ?", email, account.Uid)
+	if err != nil {
+		return err
+	}
+	t.audit(account.Uid, account.Uid, AuditEmailChange, email, params.ClientIp, params.UserAgent)
+	return nil
+}
+
+type RequestPasswdResetParams struct {
+	User      string
+	ClientIp  string
+	UserAgent string
+}
+
+// mail a reset token to the account's address. Whether the account exists or
+// has an address is not revealed.
+func (t *SessionManager) RequestPasswdReset(params *RequestPasswdResetParams) error {
+	if !t.mail.enabled() {
+		return TennisApiError{errorType: InvalidQuery, message: "Passwd reset is not available"}
+	}
+	account, err := getAccountByUser(t.db, params.User)
+	if _, ok := err.(TennisApiError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var email string
+	err = t.db.QueryRowContext(context.Background(), "SELECT `email` FROM `accounts` WHERE `uid` = ?", account.Uid).Scan(&email)
+	if err != nil {
+		return err
+	}
+	if email == "" || account.Disabled {
+		return nil
+	}
+	token := newSessionId()
+	now := time.Now().UTC()
+	sent := false
+	err = t.withTx(func(tx *sql.Tx) error {
+		var recent int
+		err := tx.QueryRowContext(context.Background(), "SELECT COUNT(`uid`) FROM `passwd_resets` WHERE `account` = ? AND `created_at` > ?", account.Uid, now.Add(-passwd_reset_interval)).Scan(&recent)
+		if err != nil || recent > 0 {
+			return err
+		}
+		_, err = tx.ExecContext(context.Background(), "INSERT INTO `passwd_resets` (`account`, `token_hash`, `expiry`, `created_at`) VALUES (?, ?, ?, ?)", account.Uid, hashSessionId(token), now.Add(passwd_reset_expiry), now)
+		sent = err == nil
+		return err
+	})
+	if err != nil || !sent {
+		return err
+	}
+	t.audit(account.Uid, 0, AuditPasswdResetRequest, "", params.ClientIp, params.UserAgent)
+	// do not let the response time tell whether a mail was sent
+	go (func() {
+		body := fmt.Sprintf("A passwd reset was requested for your XJTUTennis account %s from %s.\n\nYour reset token, valid until %s:\n\n%s\n\nIf this was not you, ignore this mail.", account.User, params.ClientIp, now.Add(passwd_reset_expiry).In(t.timeZone).Format(time.RFC3339), token)
+		err := t.mail.send(email, "XJTUTennis passwd reset", body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR Mail SMTP] %s %s\n", time.Now().Format(time.RFC3339), err.Error())
+		}
+	})()
+	return nil
+}
+
+type ResetPasswdParams struct {
+	Token     string
+	NewPasswd string
+	ClientIp  string
+	UserAgent string
+}
+
+// set a new passwd with a mailed token, signing the account out everywhere
+func (t *SessionManager) ResetPasswd(params *ResetPasswdParams) error {
+	ctx := context.Background()
+	token_hash := hashSessionId(SessionId(params.Token))
+	var uid int64
+	err := t.db.QueryRowContext(ctx, "SELECT `account` FROM `passwd_resets` WHERE `token_hash` = ? AND `used` = 0 AND `expiry` > ?", token_hash, time.Now().UTC()).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return TennisApiError{errorType: InvalidQuery, message: "Invalid or expired reset token"}
+	}
+	if err != nil {
+		return err
+	}
+	account, err := getAccount(t.db, uid)
+	if err != nil {
+		return err
+	}
+	err = t.passwdPolicy.check(account.User, params.NewPasswd)
+	if err != nil {
+		return err
+	}
+	// bcrypt is slow, so it must not run while holding the write lock
+	hash, err := hashPasswd(params.NewPasswd)
+	if err != nil {
+		return err
+	}
+	err = t.withTx(func(tx *sql.Tx) error {
+		// the token may have been spent in the meantime
+		res, err := tx.ExecContext(ctx, "UPDATE `passwd_resets` SET `used` = 1 WHERE `token_hash` = ? AND `used` = 0", token_hash)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return TennisApiError{errorType: InvalidQuery, message: "Invalid or expired reset token"}
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE `accounts` SET `passwd` = ? WHERE `uid` = ?", hash, uid)
+		if err != nil {
+			return err
+		}
+		// every outstanding token is spent, not only this one
+		_, err = tx.ExecContext(ctx, "UPDATE `passwd_resets` SET `used` = 1 WHERE `account` = ?", uid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM `sessions` WHERE `account` = ?", uid)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	t.audit(account.Uid, account.Uid, AuditPasswdReset, "email", params.ClientIp, params.UserAgent)
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-viper/mapstructure/v2"
@@ -18,17 +19,21 @@ type Response struct {
 }
 
 func makeResponse(s *SessionManager, c *gin.Context, callback func(s *SessionManager, params map[string]interface{}) (interface{}, error)) {
-	var params map[string]interface{}
+	params := make(map[string]interface{})
 	if c.Request.Method == "GET" || c.Request.Method == "DELETE" {
-		params = make(map[string]interface{})
 		for k, v := range c.Request.URL.Query() {
+			// URLs end up in logs and browser history, so passwds are only taken from the body
+			if strings.HasSuffix(k, "Passwd") {
+				continue
+			}
 			if len(v) == 1 {
 				params[k] = v[0]
 			} else {
 				params[k] = v
 			}
 		}
-	} else if c.Request.Method == "POST" || c.Request.Method == "PUT" {
+	}
+	if c.Request.Method == "POST" || c.Request.Method == "PUT" || c.Request.Method == "DELETE" {
 		req_body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
 			err = TennisApiError{errorType: InternalServerError, message: err.Error()}
@@ -41,27 +46,45 @@ func makeResponse(s *SessionManager, c *gin.Context, callback func(s *SessionMan
 			return
 		}
 
-		err = json.Unmarshal(req_body, &params)
-		if err != nil {
-			err = TennisApiError{errorType: MalformedData, message: "json parse failed"}
-			err_response := Response{
-				Success: false,
-				Message: err.Error(),
-				Data:    nil,
+		// the body of a DELETE is optional, and adds to its query parameters
+		if c.Request.Method != "DELETE" || len(req_body) > 0 {
+			var body_params map[string]interface{}
+			err = json.Unmarshal(req_body, &body_params)
+			if err != nil {
+				err = TennisApiError{errorType: MalformedData, message: "json parse failed"}
+				err_response := Response{
+					Success: false,
+					Message: err.Error(),
+					Data:    nil,
+				}
+				c.JSON(err.(TennisApiError).ToHttpStatus(), err_response)
+				return
+			}
+			for k, v := range body_params {
+				params[k] = v
 			}
-			c.JSON(err.(TennisApiError).ToHttpStatus(), err_response)
-			return
 		}
 	}
-	session, err := c.Cookie("session_id")
-
-	// inject session
+	// inject path parameters, e.g. :Uid
+	for _, param := range c.Params {
+		params[param.Key] = param.Value
+	}
+	// inject session, preferring an API token in the Authorization header.
+	// An API token is held to its scope however it was sent.
+	var scope_err error = nil
+	session := requestSession(c)
+	params["Session"] = session
+	if isApiToken(session) {
+		scope_err = s.checkApiTokenScope(session, c.Request.Method != "GET")
+	}
+	// inject client info
+	params["ClientIp"] = c.ClientIP()
+	params["UserAgent"] = c.Request.UserAgent()
+	var data interface{} = nil
+	err := scope_err
 	if err == nil {
-		params["Session"] = session
-	} else {
-		params["Session"] = "" // in this way no session will return "not logged in" instead of "malformed data"
+		data, err = callback(s, params)
 	}
-	data, err := callback(s, params)
 	if err != nil {
 		err_response := Response{
 			Success: false,
@@ -98,6 +121,19 @@ func makeResponse(s *SessionManager, c *gin.Context, callback func(s *SessionMan
 		c.JSON(http.StatusOK, response)
 	}
 }
+
+// the session id or API token of a request, empty if there is none, so that
+// it fails with "not logged in" instead of "malformed data"
+func requestSession(c *gin.Context) SessionId {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return SessionId(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	}
+	session, err := c.Cookie("session_id")
+	if err != nil {
+		return ""
+	}
+	return SessionId(session)
+}
 func decodeParams[T interface{}](params map[string]interface{}) (*T, error) {
 	var param T
 	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
@@ -114,6 +150,13 @@ func decodeParams[T interface{}](params map[string]interface{}) (*T, error) {
 	}
 	return &param, nil
 }
+
+// fill in an optional parameter, as decodeParams requires every field to be set
+func setDefaultParam(params map[string]interface{}, key string, value interface{}) {
+	if _, ok := params[key]; !ok {
+		params[key] = value
+	}
+}
 func restVersion(s *SessionManager, c *gin.Context) {
 	makeResponse(s, c, func(s *SessionManager, _ map[string]interface{}) (interface{}, error) {
 		return s.Version()
@@ -128,6 +171,33 @@ func restLogin(s *SessionManager, c *gin.Context) {
 		return s.Login(param)
 	})
 }
+func restRegister(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[RegisterParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.Register(param)
+	})
+}
+func restLoginSso(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[LoginSsoParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.LoginSso(param)
+	})
+}
+func restLoginTotp(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[LoginTotpParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.LoginTotp(param)
+	})
+}
 func restGetLoginAccount(s *SessionManager, c *gin.Context) {
 	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
 		param, err := decodeParams[SessionOnlyParams](params)
@@ -139,7 +209,7 @@ func restGetLoginAccount(s *SessionManager, c *gin.Context) {
 }
 func restSignOut(s *SessionManager, c *gin.Context) {
 	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
-		param, err := decodeParams[SessionOnlyParams](params)
+		param, err := decodeParams[SignOutParams](params)
 		if err != nil {
 			return nil, err
 		}
@@ -149,6 +219,7 @@ func restSignOut(s *SessionManager, c *gin.Context) {
 }
 func restChangePasswd(s *SessionManager, c *gin.Context) {
 	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "RevokeOtherSessions", false)
 		param, err := decodeParams[ChangePasswdParams](params)
 		if err != nil {
 			return nil, err
@@ -158,6 +229,7 @@ func restChangePasswd(s *SessionManager, c *gin.Context) {
 }
 func restChangeNetIdPasswd(s *SessionManager, c *gin.Context) {
 	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "RevokeOtherSessions", false)
 		param, err := decodeParams[ChangeNetIdPasswdParams](params)
 		if err != nil {
 			return nil, err
@@ -165,9 +237,148 @@ func restChangeNetIdPasswd(s *SessionManager, c *gin.Context) {
 		return nil, s.ChangeNetIdPasswd(param)
 	})
 }
+func restGetTotpStatus(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.GetTotpStatus(param)
+	})
+}
+func restEnrollTotp(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.EnrollTotp(param)
+	})
+}
+func restConfirmTotp(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[ConfirmTotpParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.ConfirmTotp(param)
+	})
+}
+func restDisableTotp(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[DisableTotpParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.DisableTotp(param)
+	})
+}
+func restListApiTokens(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.ListApiTokens(param)
+	})
+}
+func restCreateApiToken(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[CreateApiTokenParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.CreateApiToken(param)
+	})
+}
+func restRevokeApiToken(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[RevokeApiTokenParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.RevokeApiToken(param)
+	})
+}
+func restListSessions(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.ListSessions(param)
+	})
+}
+func restRevokeSessions(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "Uid", 0)
+		setDefaultParam(params, "Others", false)
+		param, err := decodeParams[RevokeSessionsParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.RevokeSessions(param)
+	})
+}
+
+func restVerifyNetId(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "NetId", "")
+		param, err := decodeParams[VerifyNetIdParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.VerifyNetId(param)
+	})
+}
+func restListNetIds(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.ListNetIds(param)
+	})
+}
+func restAddNetId(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[AddNetIdParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.AddNetId(param)
+	})
+}
+func restChangeExtraNetIdPasswd(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[ChangeExtraNetIdPasswdParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.ChangeExtraNetIdPasswd(param)
+	})
+}
+func restRemoveNetId(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[RemoveNetIdParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.RemoveNetId(param)
+	})
+}
 
 func restPlaceReservation(s *SessionManager, c *gin.Context) {
 	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "NetId", "")
+		setDefaultParam(params, "Target", "")
+		if _, ok := params["Template"]; ok {
+			param, err := decodeParams[PlaceReservationFromTemplateParams](params)
+			if err != nil {
+				return nil, err
+			}
+			return s.PlaceReservationFromTemplate(param)
+		}
 		param, err := decodeParams[PlaceReservationParams](params)
 		if err != nil {
 			return nil, err
@@ -175,8 +386,29 @@ func restPlaceReservation(s *SessionManager, c *gin.Context) {
 		return s.PlaceReservation(param)
 	})
 }
+func restEditReservation(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "Target", "")
+		param, err := decodeParams[EditReservationParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.EditReservation(param)
+	})
+}
+func restGetReservation(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "Target", "")
+		param, err := decodeParams[GetReservationParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.GetReservation(param)
+	})
+}
 func restCancelReservation(s *SessionManager, c *gin.Context) {
 	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "Target", "")
 		param, err := decodeParams[CancelReservationParams](params)
 		if err != nil {
 			return nil, err
@@ -186,6 +418,12 @@ func restCancelReservation(s *SessionManager, c *gin.Context) {
 }
 func restGetReservations(s *SessionManager, c *gin.Context) {
 	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "Target", "")
+		for _, key := range []string{"Status", "Site", "DateFrom", "DateTo", "ReserveOnFrom", "ReserveOnTo", "Search"} {
+			setDefaultParam(params, key, "")
+		}
+		setDefaultParam(params, "SortBy", "CreatedAt")
+		setDefaultParam(params, "SortOrder", "desc")
 		param, err := decodeParams[GetReservationsParams](params)
 		if err != nil {
 			return nil, err
@@ -194,18 +432,282 @@ func restGetReservations(s *SessionManager, c *gin.Context) {
 	})
 }
 
+func restAdminListAccounts(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.AdminListAccounts(param)
+	})
+}
+func restAdminCreateAccount(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "Admin", false)
+		param, err := decodeParams[AdminCreateAccountParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.AdminCreateAccount(param)
+	})
+}
+func restAdminSetAccountDisabled(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[AdminSetAccountDisabledParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.AdminSetAccountDisabled(param)
+	})
+}
+func restAdminResetPasswd(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[AdminResetPasswdParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.AdminResetPasswd(param)
+	})
+}
+func restAdminMintInvite(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[AdminMintInviteParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.AdminMintInvite(param)
+	})
+}
+func restGetAuditLog(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[GetAuditLogParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.GetAuditLog(param)
+	})
+}
+func restAdminGetAuditLog(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "Account", 0)
+		setDefaultParam(params, "Action", "")
+		param, err := decodeParams[AdminGetAuditLogParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.AdminGetAuditLog(param)
+	})
+}
+func restChangeEmail(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[ChangeEmailParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.ChangeEmail(param)
+	})
+}
+func restRequestPasswdReset(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[RequestPasswdResetParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.RequestPasswdReset(param)
+	})
+}
+func restResetPasswd(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[ResetPasswdParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.ResetPasswd(param)
+	})
+}
+func restListDelegations(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.ListDelegations(param)
+	})
+}
+func restGrantDelegation(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[GrantDelegationParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.GrantDelegation(param)
+	})
+}
+func restRevokeDelegation(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[RevokeDelegationParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.RevokeDelegation(param)
+	})
+}
+func restExportAccount(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.ExportAccount(param)
+	})
+}
+func restDeleteAccount(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[DeleteAccountParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.DeleteAccount(param)
+	})
+}
+func restListRules(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.ListRules(param)
+	})
+}
+func restCreateRule(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		setDefaultParam(params, "NetId", "")
+		if rule, ok := params["Rule"].(map[string]interface{}); ok {
+			setDefaultParam(rule, "EndDate", "")
+		}
+		param, err := decodeParams[CreateRuleParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.CreateRule(param)
+	})
+}
+func restEditRule(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		if rule, ok := params["Rule"].(map[string]interface{}); ok {
+			setDefaultParam(rule, "EndDate", "")
+		}
+		param, err := decodeParams[EditRuleParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.EditRule(param)
+	})
+}
+func restDeleteRule(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[DeleteRuleParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.DeleteRule(param)
+	})
+}
+func restListTemplates(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[SessionOnlyParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.ListTemplates(param)
+	})
+}
+func restCreateTemplate(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[CreateTemplateParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return s.CreateTemplate(param)
+	})
+}
+func restEditTemplate(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[EditTemplateParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.EditTemplate(param)
+	})
+}
+func restDeleteTemplate(s *SessionManager, c *gin.Context) {
+	makeResponse(s, c, func(s *SessionManager, params map[string]interface{}) (interface{}, error) {
+		param, err := decodeParams[DeleteTemplateParams](params)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.DeleteTemplate(param)
+	})
+}
 func ServeHTTP(s *SessionManager, port int) {
 	r := gin.Default()
 
 	r.GET("/api/version", func(c *gin.Context) { restVersion(s, c) })
 	r.GET("/api/login", func(c *gin.Context) { restGetLoginAccount(s, c) })
 	r.POST("/api/login", func(c *gin.Context) { restLogin(s, c) })
+	r.POST("/api/register", func(c *gin.Context) { restRegister(s, c) })
+	r.POST("/api/login/totp", func(c *gin.Context) { restLoginTotp(s, c) })
+	r.POST("/api/login/sso", func(c *gin.Context) { restLoginSso(s, c) })
 	r.DELETE("/api/login", func(c *gin.Context) { restSignOut(s, c) })
 	r.PUT("/api/passwd", func(c *gin.Context) { restChangePasswd(s, c) })
 	r.PUT("/api/netid_passwd", func(c *gin.Context) { restChangeNetIdPasswd(s, c) })
+	r.GET("/api/account/export", func(c *gin.Context) { restExportAccount(s, c) })
+	r.DELETE("/api/account", func(c *gin.Context) { restDeleteAccount(s, c) })
+	r.PUT("/api/email", func(c *gin.Context) { restChangeEmail(s, c) })
+	r.POST("/api/passwd_reset", func(c *gin.Context) { restRequestPasswdReset(s, c) })
+	r.PUT("/api/passwd_reset", func(c *gin.Context) { restResetPasswd(s, c) })
+	r.POST("/api/netid/verify", func(c *gin.Context) { restVerifyNetId(s, c) })
+	r.GET("/api/netids", func(c *gin.Context) { restListNetIds(s, c) })
+	r.POST("/api/netids", func(c *gin.Context) { restAddNetId(s, c) })
+	r.PUT("/api/netids", func(c *gin.Context) { restChangeExtraNetIdPasswd(s, c) })
+	r.DELETE("/api/netids", func(c *gin.Context) { restRemoveNetId(s, c) })
+	r.GET("/api/totp", func(c *gin.Context) { restGetTotpStatus(s, c) })
+	r.POST("/api/totp", func(c *gin.Context) { restEnrollTotp(s, c) })
+	r.PUT("/api/totp", func(c *gin.Context) { restConfirmTotp(s, c) })
+	r.POST("/api/totp/disable", func(c *gin.Context) { restDisableTotp(s, c) })
+	r.GET("/api/sessions", func(c *gin.Context) { restListSessions(s, c) })
+	r.DELETE("/api/sessions", func(c *gin.Context) { restRevokeSessions(s, c) })
+	r.GET("/api/tokens", func(c *gin.Context) { restListApiTokens(s, c) })
+	r.POST("/api/tokens", func(c *gin.Context) { restCreateApiToken(s, c) })
+	r.DELETE("/api/tokens", func(c *gin.Context) { restRevokeApiToken(s, c) })
 
 	r.POST("/api/reservations", func(c *gin.Context) { restPlaceReservation(s, c) })
 	r.GET("/api/reservations", func(c *gin.Context) { restGetReservations(s, c) })
+	r.PUT("/api/reservations", func(c *gin.Context) { restEditReservation(s, c) })
+	r.GET("/api/reservations/:Uid", func(c *gin.Context) { restGetReservation(s, c) })
 	r.DELETE("/api/reservations", func(c *gin.Context) { restCancelReservation(s, c) })
+
+	r.GET("/api/templates", func(c *gin.Context) { restListTemplates(s, c) })
+	r.POST("/api/templates", func(c *gin.Context) { restCreateTemplate(s, c) })
+	r.PUT("/api/templates", func(c *gin.Context) { restEditTemplate(s, c) })
+	r.DELETE("/api/templates", func(c *gin.Context) { restDeleteTemplate(s, c) })
+
+	r.GET("/api/rules", func(c *gin.Context) { restListRules(s, c) })
+	r.POST("/api/rules", func(c *gin.Context) { restCreateRule(s, c) })
+	r.PUT("/api/rules", func(c *gin.Context) { restEditRule(s, c) })
+	r.DELETE("/api/rules", func(c *gin.Context) { restDeleteRule(s, c) })
+
+	r.GET("/api/delegations", func(c *gin.Context) { restListDelegations(s, c) })
+	r.POST("/api/delegations", func(c *gin.Context) { restGrantDelegation(s, c) })
+	r.DELETE("/api/delegations", func(c *gin.Context) { restRevokeDelegation(s, c) })
+
+	r.GET("/api/audit", func(c *gin.Context) { restGetAuditLog(s, c) })
+
+	r.GET("/api/admin/accounts", func(c *gin.Context) { restAdminListAccounts(s, c) })
+	r.POST("/api/admin/accounts", func(c *gin.Context) { restAdminCreateAccount(s, c) })
+	r.PUT("/api/admin/accounts", func(c *gin.Context) { restAdminSetAccountDisabled(s, c) })
+	r.PUT("/api/admin/accounts/passwd", func(c *gin.Context) { restAdminResetPasswd(s, c) })
+	r.POST("/api/admin/invites", func(c *gin.Context) { restAdminMintInvite(s, c) })
+	r.GET("/api/admin/audit", func(c *gin.Context) { restAdminGetAuditLog(s, c) })
 	r.Run(fmt.Sprintf("0.0.0.0:%d", port))
 }
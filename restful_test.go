@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestApiTokenScope(t *testing.T) {
+	_, s := newTestSessionManager(t)
+	session := testLogin(t, s, "foo", "pw")
+	tokens := make(map[string]SessionId)
+	for _, scope := range []string{ApiTokenRead, ApiTokenWrite} {
+		created, err := s.CreateApiToken(&CreateApiTokenParams{Session: session, Name: scope, Scope: scope})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[scope] = created.Token
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/login", func(c *gin.Context) { restGetLoginAccount(s, c) })
+	r.POST("/api/reservations", func(c *gin.Context) { restPlaceReservation(s, c) })
+
+	cases := []struct {
+		scope  string
+		cookie bool
+		method string
+		status int
+	}{
+		{ApiTokenRead, false, "GET", http.StatusOK},
+		{ApiTokenRead, false, "POST", http.StatusForbidden},
+		{ApiTokenRead, true, "GET", http.StatusOK},
+		{ApiTokenRead, true, "POST", http.StatusForbidden},
+		{ApiTokenWrite, false, "GET", http.StatusOK},
+		{ApiTokenWrite, false, "POST", http.StatusOK},
+		{ApiTokenWrite, true, "GET", http.StatusOK},
+		{ApiTokenWrite, true, "POST", http.StatusOK},
+	}
+	for _, tc := range cases {
+		var req *http.Request
+		if tc.method == "GET" {
+			req = httptest.NewRequest("GET", "/api/login", nil)
+		} else {
+			req = httptest.NewRequest("POST", "/api/reservations", strings.NewReader(`{"Reservation": {"Date": "2099-01-01", "Site": 1, "Preferences": [], "Priority": 1}}`))
+		}
+		if tc.cookie {
+			req.AddCookie(&http.Cookie{Name: "session_id", Value: url.QueryEscape(string(tokens[tc.scope]))})
+		} else {
+			req.Header.Set("Authorization", "Bearer "+string(tokens[tc.scope]))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s token, cookie %v, %s: got %d, want %d: %s", tc.scope, tc.cookie, tc.method, w.Code, tc.status, w.Body.String())
+		}
+	}
+}
+
+// the passwd must travel in the body, never in a URL that ends up in logs
+func TestDeleteAccountTakesPasswdFromBody(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	session := testLogin(t, s, "foo", "pw")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.DELETE("/api/account", func(c *gin.Context) { restDeleteAccount(s, c) })
+	deleteAccount := func(query string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/api/account"+query, strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: url.QueryEscape(string(session))})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	accountExists := func() bool {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM `accounts` WHERE `user` = 'foo'").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n != 0
+	}
+
+	// the right passwd, but in the URL
+	for _, body := range []string{"", `{}`} {
+		if w := deleteAccount("?Passwd=pw", body); w.Code == http.StatusOK {
+			t.Fatalf("passwd in the query string was accepted with body %q", body)
+		}
+		if !accountExists() {
+			t.Fatal("account deleted with the passwd in the query string")
+		}
+	}
+
+	if w := deleteAccount("", `{"Passwd": "pw"}`); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if accountExists() {
+		t.Fatal("account still exists")
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/endaytrer/court_reserver_interface"
+)
+
+// how often rules are checked for occurrences that have come into range
+const rule_generate_interval = time.Hour
+
+type RuleParams struct {
+	// time.Weekday values, 0 for Sunday
+	Weekdays    []int
+	Site        court_reserver_interface.Site
+	Preferences []SingleBookCompatible
+	Priority    int
+	StartDate   string
+	// empty for no end
+	EndDate string
+}
+
+func (t *RuleParams) weekdayMask() (int, error) {
+	mask := 0
+	for _, weekday := range t.Weekdays {
+		if weekday < 0 || weekday > 6 {
+			return 0, TennisApiError{errorType: MalformedData, message: "Invalid weekday"}
+		}
+		mask |= 1 << weekday
+	}
+	if mask == 0 {
+		return 0, TennisApiError{errorType: MalformedData, message: "No weekday given"}
+	}
+	return mask, nil
+}
+
+func (t *RuleParams) check() error {
+	start, err := time.Parse(DATE_FORMAT, t.StartDate)
+	if err != nil {
+		return TennisApiError{errorType: MalformedData, message: "Invalid start date"}
+	}
+	if t.EndDate != "" {
+		end, err := time.Parse(DATE_FORMAT, t.EndDate)
+		if err != nil || end.Before(start) {
+			return TennisApiError{errorType: MalformedData, message: "Invalid end date"}
+		}
+	}
+	return nil
+}
+
+type RuleInfo struct {
+	Uid   int64
+	NetId string
+	RuleParams
+	CreatedAt time.Time
+}
+
+func (t *SessionManager) ListRules(params *SessionOnlyParams) ([]RuleInfo, error) {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `uid`, `netid`, `weekdays`, `site`, `preferences`, `priority`, `start_date`, `end_date`, `created_at` FROM `reservation_rules` WHERE `account` = ? ORDER BY `uid` ASC", account.Uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ans := make([]RuleInfo, 0)
+	for rows.Next() {
+		var info RuleInfo
+		var mask int
+		var preferences string
+		err = rows.Scan(&info.Uid, &info.NetId, &mask, &info.Site, &preferences, &info.Priority, &info.StartDate, &info.EndDate, &info.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(preferences), &info.Preferences)
+		if err != nil {
+			return nil, err
+		}
+		info.Weekdays = make([]int, 0)
+		for weekday := 0; weekday < 7; weekday++ {
+			if mask&(1<<weekday) != 0 {
+				info.Weekdays = append(info.Weekdays, weekday)
+			}
+		}
+		ans = append(ans, info)
+	}
+	return ans, rows.Err()
+}
+
+type CreateRuleParams struct {
+	Session SessionId
+	// NetID to book with, empty for the primary one
+	NetId string
+	Rule  RuleParams
+}
+
+// add a rule booking Rule.Site on every one of Rule.Weekdays between the start
+// and end date. Its reservations are placed as they come into the site's
+// lookahead window.
+func (t *SessionManager) CreateRule(params *CreateRuleParams) (int64, error) {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return -1, err
+	}
+	netid, _, err := resolveNetId(t.db, account, params.NetId)
+	if err != nil {
+		return -1, err
+	}
+	mask, err := params.Rule.weekdayMask()
+	if err != nil {
+		return -1, err
+	}
+	err = params.Rule.check()
+	if err != nil {
+		return -1, err
+	}
+	data, err := json.Marshal(params.Rule.Preferences)
+	if err != nil {
+		return -1, err
+	}
+	res, err := t.db.ExecContext(context.Background(), "INSERT INTO `reservation_rules` (`account`, `netid`, `weekdays`, `site`, `preferences`, `priority`, `start_date`, `end_date`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", account.Uid, netid, mask, params.Rule.Site, data, params.Rule.Priority, params.Rule.StartDate, params.Rule.EndDate)
+	if err != nil {
+		return -1, err
+	}
+	uid, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	err = t.generateRuleReservations(uid)
+	return uid, err
+}
+
+type EditRuleParams struct {
+	Session SessionId
+	Uid     int64
+	Rule    RuleParams
+}
+
+// change a rule. Its occurrences that are still pending and not picked up
+// take the new site, preferences and priority, and those whose date the rule
+// no longer covers are dropped. Dates already generated stay generated, so
+// occurrences cancelled before are not placed again; a new weekday or an
+// earlier start date only applies after generated_until.
+func (t *SessionManager) EditRule(params *EditRuleParams) error {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return err
+	}
+	mask, err := params.Rule.weekdayMask()
+	if err != nil {
+		return err
+	}
+	err = params.Rule.check()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(params.Rule.Preferences)
+	if err != nil {
+		return err
+	}
+	start, _ := time.ParseInLocation(DATE_FORMAT, params.Rule.StartDate, t.timeZone)
+	end, end_err := time.ParseInLocation(DATE_FORMAT, params.Rule.EndDate, t.timeZone)
+	var netid string
+	booked := make([]ruleOccurrence, 0)
+	err = t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		err := tx.QueryRowContext(ctx, "UPDATE `reservation_rules` SET `weekdays` = ?, `site` = ?, `preferences` = ?, `priority` = ?, `start_date` = ?, `end_date` = ? WHERE `account` = ? AND `uid` = ? RETURNING `netid`", mask, params.Rule.Site, data, params.Rule.Priority, params.Rule.StartDate, params.Rule.EndDate, account.Uid, params.Uid).Scan(&netid)
+		if err == sql.ErrNoRows {
+			return TennisApiError{errorType: InvalidQuery, message: "No matching rule"}
+		}
+		if err != nil {
+			return err
+		}
+		// occurrences whose date has passed are left to wakeUp, as they can
+		// no longer be booked
+		today := time.Now().In(t.timeZone).Format(DATE_FORMAT)
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT `uid`, `date` FROM `reservations` WHERE `rule` = ? AND `status_code` = %d AND `picked_up` = 0 AND `date` >= ?", int(court_reserver_interface.Pending)), params.Uid, today)
+		if err != nil {
+			return err
+		}
+		occurrences := make(map[int64]string)
+		for rows.Next() {
+			var uid int64
+			var date string
+			err = rows.Scan(&uid, &date)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			occurrences[uid] = date
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for uid, date := range occurrences {
+			reservation := ReservationCompatible{Date: date, Site: params.Rule.Site, Preferences: params.Rule.Preferences, Priority: params.Rule.Priority}
+			day, err := time.ParseInLocation(DATE_FORMAT, date, t.timeZone)
+			if err != nil {
+				return err
+			}
+			if mask&(1<<int(day.Weekday())) == 0 || day.Before(start) || (end_err == nil && day.After(end)) {
+				err = deleteRuleOccurrences(tx, "`uid` = ?", uid)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			_, reserve_on, book_now, err := t.reserveOn(&reservation)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "UPDATE `reservations` SET `site` = ?, `preferences` = ?, `priority` = ?, `reserve_on` = ?, `picked_up` = ? WHERE `uid` = ?", reservation.Site, data, reservation.Priority, reserve_on, book_now, uid)
+			if err != nil {
+				return err
+			}
+			err = recordReservationEvent(tx, uid, EventSourceUser, court_reserver_interface.ReservationStatus{Code: court_reserver_interface.Pending, Msg: fmt.Sprintf("Rule #%d edited, booking on %s", params.Uid, reserve_on)})
+			if err != nil {
+				return err
+			}
+			if book_now {
+				booked = append(booked, ruleOccurrence{uid: uid, account: account.Uid, netid: netid, date: day, reservation: reservation, book_now: true})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, occurrence := range booked {
+		netid_passwd, err := lookupNetIdPasswd(t.db, occurrence.account, occurrence.netid)
+		if err != nil {
+			return err
+		}
+		t.bookNow(occurrence.uid, occurrence.netid, netid_passwd, occurrence.date, &occurrence.reservation)
+	}
+	return t.generateRuleReservations(params.Uid)
+}
+
+type DeleteRuleParams struct {
+	Session SessionId
+	Uid     int64
+}
+
+// end a rule, cancelling its occurrences that are still pending and not
+// picked up
+func (t *SessionManager) DeleteRule(params *DeleteRuleParams) error {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return err
+	}
+	return t.withTx(func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(context.Background(), "DELETE FROM `reservation_rules` WHERE `account` = ? AND `uid` = ?", account.Uid, params.Uid)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return TennisApiError{errorType: InvalidQuery, message: "No matching rule"}
+		}
+		return deleteRuleOccurrences(tx, "`rule` = ?", params.Uid)
+	})
+}
+
+// delete the occurrences matching where that are still pending and not
+// picked up, together with their history
+func deleteRuleOccurrences(tx *sql.Tx, where string, args ...any) error {
+	ctx := context.Background()
+	where = fmt.Sprintf("%s AND `status_code` = %d AND `picked_up` = 0", where, int(court_reserver_interface.Pending))
+	_, err := tx.ExecContext(ctx, "DELETE FROM `reservation_events` WHERE `reservation` IN (SELECT `uid` FROM `reservations` WHERE "+where+")", args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM `reservations` WHERE "+where, args...)
+	return err
+}
+
+type ruleOccurrence struct {
+	uid         int64
+	account     int64
+	netid       string
+	date        time.Time
+	reservation ReservationCompatible
+	book_now    bool
+}
+
+// place the reservations of rule (or of every rule, if 0) whose dates have
+// come within their site's lookahead window, plus one day so that they are
+// in place before wakeUp runs. Dates up to generated_until were handled
+// before, so a cancelled occurrence is not placed again.
+func (t *SessionManager) generateRuleReservations(rule int64) error {
+	now := time.Now().In(t.timeZone)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, t.timeZone)
+	placed := make([]ruleOccurrence, 0)
+	err := t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		rows, err := tx.QueryContext(ctx, "SELECT `reservation_rules`.`uid`, `account`, `reservation_rules`.`netid`, `weekdays`, `site`, `preferences`, `priority`, `start_date`, `end_date`, `generated_until` FROM `reservation_rules` JOIN `accounts` ON `accounts`.`uid` = `account` WHERE (? = 0 OR `reservation_rules`.`uid` = ?) AND `disabled` = 0", rule, rule)
+		if err != nil {
+			return err
+		}
+		type ruleRow struct {
+			uid, account                             int64
+			netid                                    string
+			mask                                     int
+			reservation                              ReservationCompatible
+			preferences, start, end, generated_until string
+		}
+		rules := make([]ruleRow, 0)
+		for rows.Next() {
+			var r ruleRow
+			err = rows.Scan(&r.uid, &r.account, &r.netid, &r.mask, &r.reservation.Site, &r.preferences, &r.reservation.Priority, &r.start, &r.end, &r.generated_until)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			rules = append(rules, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, r := range rules {
+			err = json.Unmarshal([]byte(r.preferences), &r.reservation.Preferences)
+			if err != nil {
+				return err
+			}
+			until := today.AddDate(0, 0, court_reserver_interface.SiteLookahead(r.reservation.Site)+1)
+			if end, err := time.ParseInLocation(DATE_FORMAT, r.end, t.timeZone); err == nil && end.Before(until) {
+				until = end
+			}
+			from, err := time.ParseInLocation(DATE_FORMAT, r.start, t.timeZone)
+			if err != nil {
+				return err
+			}
+			if from.Before(today) {
+				from = today
+			}
+			if done, err := time.ParseInLocation(DATE_FORMAT, r.generated_until, t.timeZone); err == nil && !done.Before(from) {
+				from = done.AddDate(0, 0, 1)
+			}
+			for date := from; !date.After(until); date = date.AddDate(0, 0, 1) {
+				if r.mask&(1<<int(date.Weekday())) == 0 {
+					continue
+				}
+				reservation := r.reservation
+				reservation.Date = date.Format(DATE_FORMAT)
+				_, reserve_on, book_now, err := t.reserveOn(&reservation)
+				if err != nil {
+					return err
+				}
+				data, err := json.Marshal(reservation.Preferences)
+				if err != nil {
+					return err
+				}
+				// dates that already have an occurrence, e.g. one that was
+				// booked before the rule was edited, are skipped
+				res, err := tx.ExecContext(ctx, "INSERT INTO `reservations` (`account`, `netid`, `passwd`, `date`, `site`, `preferences`, `priority`, `reserve_on`, `picked_up`, `rule`) SELECT ?, ?, '', ?, ?, ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM `reservations` WHERE `rule` = ? AND `date` = ?)", r.account, r.netid, reservation.Date, reservation.Site, data, reservation.Priority, reserve_on, book_now, r.uid, r.uid, reservation.Date)
+				if err != nil {
+					return err
+				}
+				n, err := res.RowsAffected()
+				if err != nil {
+					return err
+				}
+				if n == 0 {
+					continue
+				}
+				uid, err := res.LastInsertId()
+				if err != nil {
+					return err
+				}
+				err = recordReservationEvent(tx, uid, EventSourceScheduler, court_reserver_interface.ReservationStatus{Code: court_reserver_interface.Pending, Msg: fmt.Sprintf("Placed by rule #%d, booking on %s", r.uid, reserve_on)})
+				if err != nil {
+					return err
+				}
+				placed = append(placed, ruleOccurrence{uid: uid, account: r.account, netid: r.netid, date: date, reservation: reservation, book_now: book_now})
+			}
+			if !until.Before(from) {
+				_, err = tx.ExecContext(ctx, "UPDATE `reservation_rules` SET `generated_until` = ? WHERE `uid` = ?", until.Format(DATE_FORMAT), r.uid)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, occurrence := range placed {
+		fmt.Printf("[Info] %s Placed reservation %d on %s for rule of account %d\n", time.Now().Format(time.RFC3339), occurrence.uid, occurrence.reservation.Date, occurrence.account)
+		if !occurrence.book_now {
+			continue
+		}
+		netid_passwd, err := lookupNetIdPasswd(t.db, occurrence.account, occurrence.netid)
+		if err != nil {
+			return err
+		}
+		t.bookNow(occurrence.uid, occurrence.netid, netid_passwd, occurrence.date, &occurrence.reservation)
+	}
+	return nil
+}
+
+// periodically place the reservations of every rule
+func (t *SessionManager) GenerateRuleReservations() {
+	for {
+		err := t.generateRuleReservations(0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR Rule GENERATE] %s %s\n", time.Now().Format(time.RFC3339), err.Error())
+		}
+		time.Sleep(rule_generate_interval)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEditRuleKeepsCancelledOccurrences(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	session := testLogin(t, s, "foo", "pw")
+	today := time.Now().In(s.timeZone).Format(DATE_FORMAT)
+	rule := RuleParams{Weekdays: []int{0, 1, 2, 3, 4, 5, 6}, Site: 1, Preferences: []SingleBookCompatible{}, Priority: 1, StartDate: today, EndDate: ""}
+	uid, err := s.CreateRule(&CreateRuleParams{Session: session, NetId: "", Rule: rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cancelled int64
+	var cancelled_date string
+	db.QueryRow("SELECT `uid`, `date` FROM `reservations` WHERE `rule` = ? ORDER BY `date` DESC LIMIT 1", uid).Scan(&cancelled, &cancelled_date)
+	err = s.CancelReservation(&CancelReservationParams{Session: session, Uid: cancelled, Target: ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept int64
+	db.QueryRow("SELECT `uid` FROM `reservations` WHERE `rule` = ? ORDER BY `date` ASC LIMIT 1", uid).Scan(&kept)
+
+	rule.Priority = 7
+	err = s.EditRule(&EditRuleParams{Session: session, Uid: uid, Rule: rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM `reservations` WHERE `rule` = ? AND `date` = ?", uid, cancelled_date).Scan(&n)
+	if n != 0 {
+		t.Fatal("cancelled occurrence placed again")
+	}
+	var priority int
+	err = db.QueryRow("SELECT `priority` FROM `reservations` WHERE `uid` = ?", kept).Scan(&priority)
+	if err != nil || priority != 7 {
+		t.Fatalf("occurrence not updated in place: %d %v", priority, err)
+	}
+
+	// dropping every weekday but one removes the other pending occurrences
+	rule.Weekdays = []int{int(time.Now().In(s.timeZone).AddDate(0, 0, 1).Weekday())}
+	err = s.EditRule(&EditRuleParams{Session: session, Uid: uid, Rule: rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM `reservations` WHERE `rule` = ? AND `picked_up` = 0", uid).Scan(&n)
+	if n != 1 {
+		t.Fatalf("%d occurrences left, want 1", n)
+	}
+}
+
+func TestEditRuleWithPastOccurrence(t *testing.T) {
+	db, s := newTestSessionManager(t)
+	session := testLogin(t, s, "foo", "pw")
+	today := time.Now().In(s.timeZone)
+	rule := RuleParams{Weekdays: []int{0, 1, 2, 3, 4, 5, 6}, Site: 1, Preferences: []SingleBookCompatible{}, Priority: 1, StartDate: today.Format(DATE_FORMAT), EndDate: ""}
+	uid, err := s.CreateRule(&CreateRuleParams{Session: session, NetId: "", Rule: rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an occurrence that was never picked up, e.g. while the server was down
+	past := today.AddDate(0, 0, -2).Format(DATE_FORMAT)
+	res, err := db.Exec("INSERT INTO `reservations` (`account`, `netid`, `date`, `site`, `preferences`, `priority`, `reserve_on`, `rule`) SELECT `account`, `netid`, ?, `site`, `preferences`, `priority`, ?, `uid` FROM `reservation_rules` WHERE `uid` = ?", past, past, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past_uid, _ := res.LastInsertId()
+
+	rule.Priority = 3
+	err = s.EditRule(&EditRuleParams{Session: session, Uid: uid, Rule: rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var priority int
+	err = db.QueryRow("SELECT `priority` FROM `reservations` WHERE `uid` = ?", past_uid).Scan(&priority)
+	if err != nil || priority != 1 {
+		t.Fatalf("past occurrence changed: %d %v", priority, err)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM `reservations` WHERE `rule` = ? AND `priority` = 3", uid).Scan(&n)
+	if n == 0 {
+		t.Fatal("future occurrences not updated")
+	}
+}
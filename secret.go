@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// environment variable taking precedence over the master key file
+const master_key_env = "XJTUTENNIS_MASTER_KEY"
+const master_key_len = 32
+
+// marks a value sealed by SecretBox; anything else is a legacy plaintext
+const secret_prefix = "enc:v1:"
+
+// seals NetID passwds with AES-256-GCM before they are stored anywhere
+type SecretBox struct {
+	aead cipher.AEAD
+	// derived from the master key, so fingerprints change with it
+	fingerprint_key []byte
+}
+
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) != master_key_len {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", master_key_len, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("fingerprint"))
+	return &SecretBox{aead: aead, fingerprint_key: mac.Sum(nil)}, nil
+}
+
+// read a base64 encoded master key from $XJTUTENNIS_MASTER_KEY, or from
+// key_file if the variable is unset.
+func LoadMasterKey(key_file string) ([]byte, error) {
+	if encoded, ok := os.LookupEnv(master_key_env); ok {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	}
+	return ReadMasterKeyFile(key_file)
+}
+
+func ReadMasterKeyFile(key_file string) ([]byte, error) {
+	data, err := os.ReadFile(key_file)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+}
+
+func isSealedSecret(secret string) bool {
+	return strings.HasPrefix(secret, secret_prefix)
+}
+
+func (t *SecretBox) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, t.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := t.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return secret_prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// legacy plaintext values are returned as they are, so that a database
+// written by an older version keeps working until it is re-keyed.
+func (t *SecretBox) Open(secret string) (string, error) {
+	if !isSealedSecret(secret) {
+		return secret, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, secret_prefix))
+	if err != nil {
+		return "", err
+	}
+	nonce_size := t.aead.NonceSize()
+	if len(sealed) < nonce_size {
+		return "", fmt.Errorf("sealed secret too short")
+	}
+	plaintext, err := t.aead.Open(nil, sealed[:nonce_size], sealed[nonce_size:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// seal secret unless it is already sealed
+func (t *SecretBox) Reseal(secret string) (string, error) {
+	if isSealedSecret(secret) {
+		return secret, nil
+	}
+	return t.Seal(secret)
+}
+
+// HMAC-SHA256 of secret, to tell later whether it changed without keeping a
+// copy that could be opened
+func (t *SecretBox) Fingerprint(secret string) string {
+	mac := hmac.New(sha256.New, t.fingerprint_key)
+	mac.Write([]byte(secret))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
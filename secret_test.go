@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox(bytes.Repeat([]byte{1}, master_key_len))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSecretBox(bytes.Repeat([]byte{2}, master_key_len))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"", "netid passwd", "含中文的密码"} {
+		sealed, err := box.Seal(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isSealedSecret(sealed) {
+			t.Errorf("%q: sealed value %q lacks the prefix", plaintext, sealed)
+		}
+		opened, err := box.Open(sealed)
+		if err != nil || opened != plaintext {
+			t.Errorf("%q: opened %q, %v", plaintext, opened, err)
+		}
+		if _, err := other.Open(sealed); err == nil {
+			t.Errorf("%q: opened with the wrong key", plaintext)
+		}
+		resealed, err := box.Reseal(sealed)
+		if err != nil || resealed != sealed {
+			t.Errorf("%q: resealing changed a sealed value", plaintext)
+		}
+	}
+
+	// legacy plaintext passes through Open, and Reseal seals it
+	if opened, err := box.Open("legacy"); err != nil || opened != "legacy" {
+		t.Errorf("legacy value opened as %q, %v", opened, err)
+	}
+	resealed, err := box.Reseal("legacy")
+	if err != nil || !isSealedSecret(resealed) {
+		t.Errorf("legacy value resealed as %q, %v", resealed, err)
+	}
+
+	for _, sealed := range []string{secret_prefix + "not base64!", secret_prefix + "c2hvcnQ="} {
+		if _, err := box.Open(sealed); err == nil {
+			t.Errorf("opened malformed %q", sealed)
+		}
+	}
+	if _, err := NewSecretBox(make([]byte, 16)); err == nil {
+		t.Error("accepted a short key")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/endaytrer/court_reserver_interface"
+)
+
+// sessions expire after this long without activity
+const account_login_expiry = 24 * time.Hour
+
+// last_seen and expiry are only written back once they are this stale, so
+// that not every request turns into a write.
+const session_renew_interval = time.Minute
+
+const session_reap_interval = 10 * time.Minute
+
+func newSessionId() SessionId {
+	rand_bytes := make([]byte, 32)
+	_, err := rand.Read(rand_bytes)
+	if err != nil {
+		panic(err)
+	}
+	return SessionId(base64.StdEncoding.EncodeToString(rand_bytes))
+}
+
+// only the hash of a session id is stored, so a copy of the database cannot
+// be used to take over sessions.
+func hashSessionId(session SessionId) string {
+	sum := sha256.Sum256([]byte(session))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *SessionManager) newSession(account int64, client_ip string, user_agent string) (SessionId, error) {
+	session_id := newSessionId()
+	now := time.Now().UTC()
+	_, err := t.db.ExecContext(context.Background(), "INSERT INTO `sessions` (`token_hash`, `account`, `expiry`, `last_seen`, `created_at`, `ip`, `user_agent`) VALUES (?, ?, ?, ?, ?, ?, ?)", hashSessionId(session_id), account, now.Add(account_login_expiry), now, now, client_ip, user_agent)
+	if err != nil {
+		return "", err
+	}
+	return session_id, nil
+}
+
+func (t *SessionManager) getSession(session SessionId) (*Account, error) {
+	if session == "" {
+		return nil, TennisApiError{errorType: NotLoggedIn}
+	}
+	if isApiToken(session) {
+		return t.getApiTokenAccount(session)
+	}
+	token_hash := hashSessionId(session)
+	var account_uid int64
+	var expiry, last_seen time.Time
+	err := t.db.QueryRowContext(context.Background(), "SELECT `account`, `expiry`, `last_seen` FROM `sessions` WHERE `token_hash` = ?", token_hash).Scan(&account_uid, &expiry, &last_seen)
+	if err == sql.ErrNoRows {
+		return nil, TennisApiError{errorType: NotLoggedIn}
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if now.After(expiry) {
+		t.deleteSession(session)
+		return nil, TennisApiError{errorType: NotLoggedIn}
+	}
+	// sliding renewal
+	if now.Sub(last_seen) > session_renew_interval {
+		_, err = t.db.ExecContext(context.Background(), "UPDATE `sessions` SET `last_seen` = ?, `expiry` = ? WHERE `token_hash` = ?", now, now.Add(account_login_expiry), token_hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.getSessionAccount(account_uid)
+}
+
+// load the account a session or API token belongs to. Disabled accounts are
+// treated as signed out.
+func (t *SessionManager) getSessionAccount(uid int64) (*Account, error) {
+	account, err := getAccount(t.db, uid)
+	if err != nil {
+		// account has been removed in the meantime
+		if _, ok := err.(TennisApiError); ok {
+			return nil, TennisApiError{errorType: NotLoggedIn}
+		}
+		return nil, err
+	}
+	if account.Disabled {
+		return nil, TennisApiError{errorType: NotLoggedIn}
+	}
+	return account, nil
+}
+
+func (t *SessionManager) deleteSession(session SessionId) error {
+	_, err := t.db.ExecContext(context.Background(), "DELETE FROM `sessions` WHERE `token_hash` = ?", hashSessionId(session))
+	return err
+}
+
+// sign out every other session of an account, e.g. after a passwd change
+func revokeOtherSessions(tx *sql.Tx, account int64, session SessionId) error {
+	_, err := tx.ExecContext(context.Background(), "DELETE FROM `sessions` WHERE `account` = ? AND `token_hash` != ?", account, hashSessionId(session))
+	return err
+}
+
+type SessionInfo struct {
+	Uid       int64
+	CreatedAt time.Time
+	LastSeen  time.Time
+	Expiry    time.Time
+	Ip        string
+	UserAgent string
+	Current   bool
+}
+
+func (t *SessionManager) ListSessions(params *SessionOnlyParams) ([]SessionInfo, error) {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `uid`, `token_hash`, `created_at`, `last_seen`, `expiry`, `ip`, `user_agent` FROM `sessions` WHERE `account` = ? AND `expiry` >= ? ORDER BY `last_seen` DESC", account.Uid, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	current_hash := hashSessionId(params.Session)
+	ans := make([]SessionInfo, 0)
+	for rows.Next() {
+		var info SessionInfo
+		var token_hash string
+		err = rows.Scan(&info.Uid, &token_hash, &info.CreatedAt, &info.LastSeen, &info.Expiry, &info.Ip, &info.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		info.Current = token_hash == current_hash
+		ans = append(ans, info)
+	}
+	return ans, rows.Err()
+}
+
+type RevokeSessionsParams struct {
+	Session SessionId
+	// revoke the session with this uid
+	Uid int64
+	// or, if set, revoke every session except the current one
+	Others bool
+}
+
+func (t *SessionManager) RevokeSessions(params *RevokeSessionsParams) error {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return err
+	}
+	if params.Others {
+		return t.withTx(func(tx *sql.Tx) error {
+			return revokeOtherSessions(tx, account.Uid, params.Session)
+		})
+	}
+	res, err := t.db.ExecContext(context.Background(), "DELETE FROM `sessions` WHERE `account` = ? AND `uid` = ?", account.Uid, params.Uid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return TennisApiError{errorType: InvalidQuery, message: "No matching session"}
+	}
+	return nil
+}
+
+// periodically remove expired sessions and passwd reset tokens, failed login
+// records that no longer count towards a lockout, and NetID passwds left in
+// finished reservations
+func (t *SessionManager) ReapSessions() {
+	for {
+		now := time.Now().UTC()
+		res, err := t.db.ExecContext(context.Background(), "DELETE FROM `sessions` WHERE `expiry` < ?", now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR Session REAP] %s %s\n", time.Now().Format(time.RFC3339), err.Error())
+		} else if n, err := res.RowsAffected(); err == nil && n > 0 {
+			fmt.Printf("[Info] %s Reaped %d expired sessions\n", time.Now().Format(time.RFC3339), n)
+		}
+		_, err = t.db.ExecContext(context.Background(), "DELETE FROM `login_failures` WHERE `updated_at` < ? AND (`locked_until` IS NULL OR `locked_until` < ?)", now.Add(-t.loginThrottle.Window), now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR Session REAP] %s %s\n", time.Now().Format(time.RFC3339), err.Error())
+		}
+		_, err = t.db.ExecContext(context.Background(), "DELETE FROM `passwd_resets` WHERE `expiry` < ?", now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR Session REAP] %s %s\n", time.Now().Format(time.RFC3339), err.Error())
+		}
+		// reservations placed by older versions carry a copy of the NetID
+		// passwd, which is not needed once they are done
+		res, err = t.db.ExecContext(context.Background(), fmt.Sprintf("UPDATE `reservations` SET `passwd` = '' WHERE `passwd` != '' AND `status_code` != %d", int(court_reserver_interface.Pending)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR Session REAP] %s %s\n", time.Now().Format(time.RFC3339), err.Error())
+		} else if n, err := res.RowsAffected(); err == nil && n > 0 {
+			fmt.Printf("[Info] %s Removed NetID passwds from %d finished reservations\n", time.Now().Format(time.RFC3339), n)
+		}
+		time.Sleep(session_reap_interval)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSessionsApi(t *testing.T) {
+	_, s := newTestSessionManager(t)
+	sessions := make([]SessionId, 0)
+	for i := 0; i < 3; i++ {
+		res, err := s.Login(&LoginParams{User: "foo", Passwd: "pw", ClientIp: "10.0.0.1", UserAgent: fmt.Sprintf("client %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, res.(SessionId))
+	}
+	bar := testLogin(t, s, "bar", "pw2")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/sessions", func(c *gin.Context) { restListSessions(s, c) })
+	r.DELETE("/api/sessions", func(c *gin.Context) { restRevokeSessions(s, c) })
+	request := func(method string, target string, session SessionId) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: url.QueryEscape(string(session))})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	list := func(session SessionId) []SessionInfo {
+		t.Helper()
+		w := request("GET", "/api/sessions", session)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list: got %d: %s", w.Code, w.Body.String())
+		}
+		var response struct{ Data []SessionInfo }
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.Data
+	}
+	signedIn := func(session SessionId) bool {
+		_, err := s.getSession(session)
+		return err == nil
+	}
+
+	infos := list(sessions[0])
+	if len(infos) != 3 {
+		t.Fatalf("listed %d sessions, want 3", len(infos))
+	}
+	current := 0
+	uids := make(map[string]int64)
+	for _, info := range infos {
+		if info.Current {
+			current++
+			if info.UserAgent != "client 0" {
+				t.Errorf("current session is %q", info.UserAgent)
+			}
+		}
+		if info.Ip != "10.0.0.1" {
+			t.Errorf("session of %q has ip %q", info.UserAgent, info.Ip)
+		}
+		uids[info.UserAgent] = info.Uid
+	}
+	if current != 1 {
+		t.Errorf("%d sessions marked current", current)
+	}
+
+	// a single session; one of another account cannot be revoked
+	if w := request("DELETE", fmt.Sprintf("/api/sessions?Uid=%d", uids["client 1"]), bar); w.Code == http.StatusOK {
+		t.Fatal("revoked another account's session")
+	}
+	if w := request("DELETE", fmt.Sprintf("/api/sessions?Uid=%d", uids["client 1"]), sessions[0]); w.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d: %s", w.Code, w.Body.String())
+	}
+	if signedIn(sessions[1]) || !signedIn(sessions[0]) || !signedIn(sessions[2]) {
+		t.Fatal("revoking one session affected the wrong ones")
+	}
+	if len(list(sessions[0])) != 2 {
+		t.Fatal("revoked session still listed")
+	}
+
+	// all but the current one
+	if w := request("DELETE", "/api/sessions?Others=true", sessions[0]); w.Code != http.StatusOK {
+		t.Fatalf("revoke others: got %d: %s", w.Code, w.Body.String())
+	}
+	if signedIn(sessions[2]) || !signedIn(sessions[0]) || !signedIn(bar) {
+		t.Fatal("revoking other sessions affected the wrong ones")
+	}
+	if infos := list(sessions[0]); len(infos) != 1 || !infos[0].Current {
+		t.Fatalf("left %+v", infos)
+	}
+}
+
+func TestPasswdChangeRevokesOtherSessions(t *testing.T) {
+	_, s := newTestSessionManager(t)
+	current := testLogin(t, s, "foo", "pw")
+	other := testLogin(t, s, "foo", "pw")
+	kept := testLogin(t, s, "foo", "pw")
+
+	// without RevokeOtherSessions, the other sessions stay
+	err := s.ChangePasswd(&ChangePasswdParams{Session: current, OldPasswd: "pw", NewPasswd: "pw-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.getSession(kept); err != nil {
+		t.Fatal("session revoked without RevokeOtherSessions")
+	}
+
+	err = s.ChangePasswd(&ChangePasswdParams{Session: current, OldPasswd: "pw-2", NewPasswd: "pw-3", RevokeOtherSessions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range []SessionId{other, kept} {
+		if _, err := s.getSession(session); err == nil {
+			t.Error("other session still valid after the passwd change")
+		}
+	}
+	if _, err := s.getSession(current); err != nil {
+		t.Errorf("current session revoked: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// one NetID per line, empty lines and lines starting with # are ignored
+func ReadSsoWhitelist(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	whitelist := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		whitelist[line] = true
+	}
+	return whitelist, nil
+}
+
+type LoginSsoParams struct {
+	NetId     string
+	Passwd    string
+	ClientIp  string
+	UserAgent string
+}
+
+// sign in with NetID credentials, checked against CAS through xjtuorg. The
+// NetID is looked up as the primary NetID of an account; whitelisted NetIDs
+// without one get an account named after the NetID.
+func (t *SessionManager) LoginSso(params *LoginSsoParams) (interface{}, error) {
+	if params.NetId == "" {
+		return nil, TennisApiError{errorType: NonExistAccount}
+	}
+	var login_account *Account = nil
+	err := t.throttleLogin("netid:"+params.NetId, params.ClientIp, func() error {
+		err := t.checkNetIdLogin(params.NetId, params.Passwd)
+		if err != nil {
+			return err
+		}
+		sealed, err := t.secrets.Seal(params.Passwd)
+		if err != nil {
+			return err
+		}
+		// bcrypt is slow, so the passwd of an account to provision is hashed
+		// before taking the write lock
+		passwd_hash := ""
+		if t.ssoWhitelist[params.NetId] {
+			_, err := scanAccount(t.db.QueryRowContext(context.Background(), "SELECT "+account_columns+" FROM `accounts` WHERE `netid` = ? ORDER BY `uid` ASC LIMIT 1", params.NetId))
+			if _, ok := err.(TennisApiError); ok {
+				passwd_hash, err = randomPasswdHash()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return t.withTx(func(tx *sql.Tx) error {
+			ctx := context.Background()
+			account, err := scanAccount(tx.QueryRowContext(ctx, "SELECT "+account_columns+" FROM `accounts` WHERE `netid` = ? ORDER BY `uid` ASC LIMIT 1", params.NetId))
+			// passwd_hash is empty if the account was deleted meanwhile
+			if _, ok := err.(TennisApiError); ok && passwd_hash != "" {
+				account, err = provisionSsoAccount(tx, params.NetId, passwd_hash, sealed)
+				if err != nil {
+					return err
+				}
+				login_account = account
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if account.Disabled {
+				return TennisApiError{errorType: InvalidAccount, message: "Account disabled"}
+			}
+			// the passwd just worked, keep the stored one current
+			_, err = tx.ExecContext(ctx, "UPDATE `accounts` SET `netid_passwd` = ? WHERE `uid` = ?", sealed, account.Uid)
+			if err != nil {
+				return err
+			}
+			login_account = account
+			return nil
+		})
+	})
+	if err != nil {
+		var uid int64 = 0
+		t.db.QueryRowContext(context.Background(), "SELECT `uid` FROM `accounts` WHERE `netid` = ? ORDER BY `uid` ASC LIMIT 1", params.NetId).Scan(&uid)
+		t.audit(uid, uid, AuditLoginFailed, fmt.Sprintf("sso %s: %s", params.NetId, err.Error()), params.ClientIp, params.UserAgent)
+		return nil, err
+	}
+	ans, err := t.completeLogin(login_account, params.ClientIp, params.UserAgent)
+	if _, ok := ans.(SessionId); ok && err == nil {
+		t.audit(login_account.Uid, login_account.Uid, AuditLogin, "sso", params.ClientIp, params.UserAgent)
+	}
+	return ans, err
+}
+
+// the hash of a random site passwd nobody knows, for provisioned accounts;
+// their owners sign in through SSO, or have an admin reset it.
+func randomPasswdHash() (string, error) {
+	rand_bytes := make([]byte, 32)
+	_, err := rand.Read(rand_bytes)
+	if err != nil {
+		return "", err
+	}
+	return hashPasswd(base64.StdEncoding.EncodeToString(rand_bytes))
+}
+
+func provisionSsoAccount(tx *sql.Tx, netid string, passwd_hash string, sealed_passwd string) (*Account, error) {
+	var err error
+	account := &Account{User: netid, Passwd: passwd_hash, NetId: netid, NetIdPasswd: sealed_passwd}
+	account.Uid, err = insertAccount(tx, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
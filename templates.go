@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/endaytrer/court_reserver_interface"
+)
+
+type TemplateParams struct {
+	Name        string
+	Site        court_reserver_interface.Site
+	Preferences []SingleBookCompatible
+	Priority    int
+}
+
+type TemplateInfo struct {
+	Uid int64
+	TemplateParams
+	CreatedAt time.Time
+}
+
+func (t *SessionManager) ListTemplates(params *SessionOnlyParams) ([]TemplateInfo, error) {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `uid`, `name`, `site`, `preferences`, `priority`, `created_at` FROM `reservation_templates` WHERE `account` = ? ORDER BY `name` ASC", account.Uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ans := make([]TemplateInfo, 0)
+	for rows.Next() {
+		var info TemplateInfo
+		var preferences string
+		err = rows.Scan(&info.Uid, &info.Name, &info.Site, &preferences, &info.Priority, &info.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(preferences), &info.Preferences)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, info)
+	}
+	return ans, rows.Err()
+}
+
+type CreateTemplateParams struct {
+	Session  SessionId
+	Template TemplateParams
+}
+
+func (t *SessionManager) CreateTemplate(params *CreateTemplateParams) (int64, error) {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return -1, err
+	}
+	if params.Template.Name == "" {
+		return -1, TennisApiError{errorType: MalformedData, message: "Template name is empty"}
+	}
+	data, err := json.Marshal(params.Template.Preferences)
+	if err != nil {
+		return -1, err
+	}
+	res, err := t.db.ExecContext(context.Background(), "INSERT INTO `reservation_templates` (`account`, `name`, `site`, `preferences`, `priority`) VALUES (?, ?, ?, ?, ?) ON CONFLICT (`account`, `name`) DO NOTHING", account.Uid, params.Template.Name, params.Template.Site, data, params.Template.Priority)
+	if err != nil {
+		return -1, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	if n == 0 {
+		return -1, TennisApiError{errorType: InvalidQuery, message: "Template name already used"}
+	}
+	return res.LastInsertId()
+}
+
+type EditTemplateParams struct {
+	Session  SessionId
+	Uid      int64
+	Template TemplateParams
+}
+
+// replace a template. Reservations placed from it before are left as they are.
+func (t *SessionManager) EditTemplate(params *EditTemplateParams) error {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return err
+	}
+	if params.Template.Name == "" {
+		return TennisApiError{errorType: MalformedData, message: "Template name is empty"}
+	}
+	data, err := json.Marshal(params.Template.Preferences)
+	if err != nil {
+		return err
+	}
+	return t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		var taken int
+		err := tx.QueryRowContext(ctx, "SELECT COUNT(`uid`) FROM `reservation_templates` WHERE `account` = ? AND `name` = ? AND `uid` != ?", account.Uid, params.Template.Name, params.Uid).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return TennisApiError{errorType: InvalidQuery, message: "Template name already used"}
+		}
+		res, err := tx.ExecContext(ctx, "UPDATE `reservation_templates` SET `name` = ?, `site` = ?, `preferences` = ?, `priority` = ? WHERE `account` = ? AND `uid` = ?", params.Template.Name, params.Template.Site, data, params.Template.Priority, account.Uid, params.Uid)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return TennisApiError{errorType: InvalidQuery, message: "No matching template"}
+		}
+		return nil
+	})
+}
+
+type DeleteTemplateParams struct {
+	Session SessionId
+	Uid     int64
+}
+
+func (t *SessionManager) DeleteTemplate(params *DeleteTemplateParams) error {
+	account, err := t.getSession(params.Session)
+	if err != nil {
+		return err
+	}
+	res, err := t.db.ExecContext(context.Background(), "DELETE FROM `reservation_templates` WHERE `account` = ? AND `uid` = ?", account.Uid, params.Uid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return TennisApiError{errorType: InvalidQuery, message: "No matching template"}
+	}
+	return nil
+}
+
+type PlaceReservationFromTemplateParams struct {
+	Session  SessionId
+	Template int64
+	Date     string
+	// NetID to book with, empty for the primary one
+	NetId string
+	// user to book for through a delegation, empty for oneself
+	Target    string
+	ClientIp  string
+	UserAgent string
+}
+
+// place a reservation on Date with the site, preferences and priority of one of
+// the caller's templates, also when booking for someone else
+func (t *SessionManager) PlaceReservationFromTemplate(params *PlaceReservationFromTemplateParams) (int64, error) {
+	caller, err := t.getSession(params.Session)
+	if err != nil {
+		return -1, err
+	}
+	reservation := ReservationCompatible{Date: params.Date}
+	var preferences string
+	err = t.db.QueryRowContext(context.Background(), "SELECT `site`, `preferences`, `priority` FROM `reservation_templates` WHERE `account` = ? AND `uid` = ?", caller.Uid, params.Template).Scan(&reservation.Site, &preferences, &reservation.Priority)
+	if err == sql.ErrNoRows {
+		return -1, TennisApiError{errorType: InvalidQuery, message: "No matching template"}
+	}
+	if err != nil {
+		return -1, err
+	}
+	err = json.Unmarshal([]byte(preferences), &reservation.Preferences)
+	if err != nil {
+		return -1, err
+	}
+	return t.PlaceReservation(&PlaceReservationParams{
+		Session:     params.Session,
+		Reservation: reservation,
+		NetId:       params.NetId,
+		Target:      params.Target,
+		ClientIp:    params.ClientIp,
+		UserAgent:   params.UserAgent,
+	})
+}
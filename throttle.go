@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	login_throttle_account = "account"
+	login_throttle_ip      = "ip"
+)
+
+type LoginThrottleConfig struct {
+	// failed logins tolerated before an account / IP is locked
+	AccountMaxFailures int
+	IpMaxFailures      int
+	// the first lockout lasts Lockout, every further failure doubles it up
+	// to MaxLockout
+	Lockout    time.Duration
+	MaxLockout time.Duration
+	// failures are forgotten after this long without another one
+	Window time.Duration
+}
+
+func (t *LoginThrottleConfig) maxFailures(kind string) int {
+	if kind == login_throttle_ip {
+		return t.IpMaxFailures
+	}
+	return t.AccountMaxFailures
+}
+
+func (t *LoginThrottleConfig) lockout(kind string, failures int) time.Duration {
+	lockout := t.Lockout
+	for i := t.maxFailures(kind); i < failures && lockout < t.MaxLockout; i++ {
+		lockout *= 2
+	}
+	return min(lockout, t.MaxLockout)
+}
+
+func (t *SessionManager) checkLoginLock(kind string, key string) error {
+	var locked_until sql.NullTime
+	err := t.db.QueryRowContext(context.Background(), "SELECT `locked_until` FROM `login_failures` WHERE `kind` = ? AND `key` = ?", kind, key).Scan(&locked_until)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if locked_until.Valid && now.Before(locked_until.Time) {
+		return TennisApiError{errorType: TooManyAttempts, message: fmt.Sprintf("retry after %s", locked_until.Time.In(t.timeZone).Format(time.RFC3339))}
+	}
+	return nil
+}
+
+func (t *SessionManager) recordLoginFailure(kind string, key string) error {
+	return t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		now := time.Now().UTC()
+		failures := 0
+		var updated_at time.Time
+		err := tx.QueryRowContext(ctx, "SELECT `failures`, `updated_at` FROM `login_failures` WHERE `kind` = ? AND `key` = ?", kind, key).Scan(&failures, &updated_at)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && now.Sub(updated_at) > t.loginThrottle.Window {
+			failures = 0
+		}
+		failures += 1
+
+		var locked_until sql.NullTime
+		if failures >= t.loginThrottle.maxFailures(kind) {
+			lockout := t.loginThrottle.lockout(kind, failures)
+			locked_until = sql.NullTime{Time: now.Add(lockout), Valid: true}
+			fmt.Printf("[Warn] %s Login locked for %s %q after %d failed attempts, for %s\n", time.Now().Format(time.RFC3339), kind, key, failures, lockout)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO `login_failures` (`kind`, `key`, `failures`, `locked_until`, `updated_at`) VALUES (?, ?, ?, ?, ?) ON CONFLICT (`kind`, `key`) DO UPDATE SET `failures` = excluded.`failures`, `locked_until` = excluded.`locked_until`, `updated_at` = excluded.`updated_at`", kind, key, failures, locked_until, now)
+		return err
+	})
+}
+
+func (t *SessionManager) clearLoginFailures(kind string, key string) error {
+	_, err := t.db.ExecContext(context.Background(), "DELETE FROM `login_failures` WHERE `kind` = ? AND `key` = ?", kind, key)
+	return err
+}
+
+// wrap an authentication attempt by user from client_ip: refuse it while
+// either of them is locked, and count it against both if it fails with
+// WrongPasswd, WrongTotpCode, NetIdLoginFailed or NonExistAccount.
+func (t *SessionManager) throttleLogin(user string, client_ip string, attempt func() error) error {
+	if err := t.checkLoginLock(login_throttle_account, user); err != nil {
+		return err
+	}
+	if err := t.checkLoginLock(login_throttle_ip, client_ip); err != nil {
+		return err
+	}
+	err := attempt()
+	if api_err, ok := err.(TennisApiError); ok && (api_err.errorType == WrongPasswd || api_err.errorType == WrongTotpCode || api_err.errorType == NetIdLoginFailed || api_err.errorType == NonExistAccount) {
+		if err := t.recordLoginFailure(login_throttle_account, user); err != nil {
+			return err
+		}
+		if err := t.recordLoginFailure(login_throttle_ip, client_ip); err != nil {
+			return err
+		}
+		return api_err
+	}
+	if err != nil {
+		return err
+	}
+	return t.clearLoginFailures(login_throttle_account, user)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	config := LoginThrottleConfig{AccountMaxFailures: 3, IpMaxFailures: 10, Lockout: time.Minute, MaxLockout: time.Hour}
+	cases := []struct {
+		kind     string
+		failures int
+		lockout  time.Duration
+	}{
+		{login_throttle_account, 3, time.Minute},
+		{login_throttle_account, 4, 2 * time.Minute},
+		{login_throttle_account, 5, 4 * time.Minute},
+		{login_throttle_account, 8, 32 * time.Minute},
+		{login_throttle_account, 9, time.Hour},
+		{login_throttle_account, 100, time.Hour},
+		{login_throttle_ip, 10, time.Minute},
+		{login_throttle_ip, 11, 2 * time.Minute},
+	}
+	for _, tc := range cases {
+		if got := config.lockout(tc.kind, tc.failures); got != tc.lockout {
+			t.Errorf("%s after %d failures: got %s, want %s", tc.kind, tc.failures, got, tc.lockout)
+		}
+	}
+}
+
+func TestLoginThrottleLockout(t *testing.T) {
+	_, s := newTestSessionManager(t)
+	login := func(user string, passwd string, ip string) error {
+		_, err := s.Login(&LoginParams{User: user, Passwd: passwd, ClientIp: ip})
+		return err
+	}
+	errorType := func(err error) TennisApiErrorType {
+		if api_err, ok := err.(TennisApiError); ok {
+			return api_err.errorType
+		}
+		return NoError
+	}
+
+	// a success in between starts the count over
+	for i := 0; i < 2; i++ {
+		if err := login("foo", "wrong", "10.0.0.1"); errorType(err) != WrongPasswd {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if err := login("foo", "pw", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := login("foo", "wrong", "10.0.0.2"); errorType(err) != WrongPasswd {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	// locked, even with the right passwd and from another IP
+	if err := login("foo", "pw", "10.0.0.3"); errorType(err) != TooManyAttempts {
+		t.Fatalf("not locked: %v", err)
+	}
+	// other accounts are not affected
+	if err := login("bar", "pw2", "10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+}
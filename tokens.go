@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+// personal access tokens are passed as `Authorization: Bearer xtt_...` and
+// go through getSession like a session id. The prefix tells them apart.
+const api_token_prefix = "xtt_"
+
+const (
+	ApiTokenRead  = "read"
+	ApiTokenWrite = "write"
+)
+
+func isApiToken(session SessionId) bool {
+	return strings.HasPrefix(string(session), api_token_prefix)
+}
+
+func newApiToken() SessionId {
+	rand_bytes := make([]byte, 32)
+	_, err := rand.Read(rand_bytes)
+	if err != nil {
+		panic(err)
+	}
+	return SessionId(api_token_prefix + base64.RawURLEncoding.EncodeToString(rand_bytes))
+}
+
+func (t *SessionManager) getApiTokenAccount(token SessionId) (*Account, error) {
+	token_hash := hashSessionId(token)
+	var account_uid int64
+	var last_used sql.NullTime
+	err := t.db.QueryRowContext(context.Background(), "SELECT `account`, `last_used` FROM `api_tokens` WHERE `token_hash` = ?", token_hash).Scan(&account_uid, &last_used)
+	if err == sql.ErrNoRows {
+		return nil, TennisApiError{errorType: NotLoggedIn}
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if !last_used.Valid || now.Sub(last_used.Time) > session_renew_interval {
+		_, err = t.db.ExecContext(context.Background(), "UPDATE `api_tokens` SET `last_used` = ? WHERE `token_hash` = ?", now, token_hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.getSessionAccount(account_uid)
+}
+
+// refuse requests that modify anything when made with a read-only token
+func (t *SessionManager) checkApiTokenScope(token SessionId, write bool) error {
+	if !write {
+		return nil
+	}
+	var scope string
+	err := t.db.QueryRowContext(context.Background(), "SELECT `scope` FROM `api_tokens` WHERE `token_hash` = ?", hashSessionId(token)).Scan(&scope)
+	if err == sql.ErrNoRows {
+		return TennisApiError{errorType: NotLoggedIn}
+	}
+	if err != nil {
+		return err
+	}
+	if scope != ApiTokenWrite {
+		return TennisApiError{errorType: PermissionDenied, message: "API token is read-only"}
+	}
+	return nil
+}
+
+// like getSession, but refusing API tokens. Endpoints that change how the
+// account is secured (passwds, email, TOTP, tokens, sessions, delegations) or
+// that hand out or delete all of its data need a real session, so that a
+// leaked token cannot take over the account.
+func (t *SessionManager) getInteractiveSession(session SessionId) (*Account, error) {
+	if isApiToken(session) {
+		return nil, TennisApiError{errorType: PermissionDenied, message: "Not allowed with an API token"}
+	}
+	return t.getSession(session)
+}
+
+type ApiTokenInfo struct {
+	Uid       int64
+	Name      string
+	Scope     string
+	CreatedAt time.Time
+	LastUsed  *time.Time
+}
+
+func (t *SessionManager) ListApiTokens(params *SessionOnlyParams) ([]ApiTokenInfo, error) {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := t.db.QueryContext(context.Background(), "SELECT `uid`, `name`, `scope`, `created_at`, `last_used` FROM `api_tokens` WHERE `account` = ? ORDER BY `created_at` DESC", account.Uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ans := make([]ApiTokenInfo, 0)
+	for rows.Next() {
+		var info ApiTokenInfo
+		var last_used sql.NullTime
+		err = rows.Scan(&info.Uid, &info.Name, &info.Scope, &info.CreatedAt, &last_used)
+		if err != nil {
+			return nil, err
+		}
+		if last_used.Valid {
+			info.LastUsed = &last_used.Time
+		}
+		ans = append(ans, info)
+	}
+	return ans, rows.Err()
+}
+
+type CreateApiTokenParams struct {
+	Session SessionId
+	Name    string
+	Scope   string
+}
+
+type ApiTokenCreated struct {
+	Uid   int64
+	Token SessionId
+}
+
+// the token itself is only returned here; only its hash is stored
+func (t *SessionManager) CreateApiToken(params *CreateApiTokenParams) (ApiTokenCreated, error) {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return ApiTokenCreated{}, err
+	}
+	if params.Scope != ApiTokenRead && params.Scope != ApiTokenWrite {
+		return ApiTokenCreated{}, TennisApiError{errorType: MalformedData, message: "Scope must be \"read\" or \"write\""}
+	}
+	if params.Name == "" {
+		return ApiTokenCreated{}, TennisApiError{errorType: MalformedData, message: "Name must not be empty"}
+	}
+	token := newApiToken()
+	res, err := t.db.ExecContext(context.Background(), "INSERT INTO `api_tokens` (`account`, `name`, `token_hash`, `scope`) VALUES (?, ?, ?, ?)", account.Uid, params.Name, hashSessionId(token), params.Scope)
+	if err != nil {
+		return ApiTokenCreated{}, err
+	}
+	uid, err := res.LastInsertId()
+	if err != nil {
+		return ApiTokenCreated{}, err
+	}
+	return ApiTokenCreated{Uid: uid, Token: token}, nil
+}
+
+type RevokeApiTokenParams struct {
+	Session SessionId
+	Uid     int64
+}
+
+func (t *SessionManager) RevokeApiToken(params *RevokeApiTokenParams) error {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return err
+	}
+	res, err := t.db.ExecContext(context.Background(), "DELETE FROM `api_tokens` WHERE `account` = ? AND `uid` = ?", account.Uid, params.Uid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return TennisApiError{errorType: InvalidQuery, message: "No matching API token"}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+func TestCheckApiTokenScope(t *testing.T) {
+	_, s := newTestSessionManager(t)
+	session := testLogin(t, s, "foo", "pw")
+	tokens := map[string]SessionId{"unknown": newApiToken()}
+	for _, scope := range []string{ApiTokenRead, ApiTokenWrite} {
+		created, err := s.CreateApiToken(&CreateApiTokenParams{Session: session, Name: scope, Scope: scope})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[scope] = created.Token
+	}
+	cases := []struct {
+		token string
+		write bool
+		err   TennisApiErrorType
+	}{
+		{ApiTokenRead, false, NoError},
+		{ApiTokenRead, true, PermissionDenied},
+		{ApiTokenWrite, false, NoError},
+		{ApiTokenWrite, true, NoError},
+		{"unknown", true, NotLoggedIn},
+	}
+	for _, tc := range cases {
+		err := s.checkApiTokenScope(tokens[tc.token], tc.write)
+		got := NoError
+		if api_err, ok := err.(TennisApiError); ok {
+			got = api_err.errorType
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.err {
+			t.Errorf("%s token, write %v: got %v, want %v", tc.token, tc.write, err, tc.err)
+		}
+	}
+	// a read-only token must not mint itself a writable one
+	if _, err := s.CreateApiToken(&CreateApiTokenParams{Session: tokens[ApiTokenRead], Name: "escalate", Scope: ApiTokenWrite}); err == nil {
+		t.Error("API token created another API token")
+	}
+}
+
+func TestApiTokenRefusedOnAccountSecurity(t *testing.T) {
+	_, s := newTestSessionManager(t)
+	session := testLogin(t, s, "foo", "pw")
+	created, err := s.CreateApiToken(&CreateApiTokenParams{Session: session, Name: "write", Scope: ApiTokenWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := created.Token
+	calls := map[string]func() error{
+		"ChangePasswd": func() error {
+			return s.ChangePasswd(&ChangePasswdParams{Session: token, OldPasswd: "pw", NewPasswd: "a new passwd 123"})
+		},
+		"ChangeEmail": func() error {
+			return s.ChangeEmail(&ChangeEmailParams{Session: token, Email: "evil@example.com", Passwd: "pw"})
+		},
+		"EnrollTotp": func() error {
+			_, err := s.EnrollTotp(&SessionOnlyParams{Session: token})
+			return err
+		},
+		"ListApiTokens": func() error {
+			_, err := s.ListApiTokens(&SessionOnlyParams{Session: token})
+			return err
+		},
+		"ListSessions": func() error {
+			_, err := s.ListSessions(&SessionOnlyParams{Session: token})
+			return err
+		},
+		"RevokeSessions": func() error {
+			return s.RevokeSessions(&RevokeSessionsParams{Session: token, Others: true})
+		},
+		"GrantDelegation": func() error {
+			_, err := s.GrantDelegation(&GrantDelegationParams{Session: token, Delegate: "bar", Rights: DelegationView, Expiry: "1h"})
+			return err
+		},
+		"ExportAccount": func() error {
+			_, err := s.ExportAccount(&SessionOnlyParams{Session: token})
+			return err
+		},
+		"DeleteAccount": func() error {
+			return s.DeleteAccount(&DeleteAccountParams{Session: token, Passwd: "pw"})
+		},
+	}
+	for name, call := range calls {
+		err := call()
+		if api_err, ok := err.(TennisApiError); !ok || api_err.errorType != PermissionDenied {
+			t.Errorf("%s with an API token: got %v, want PermissionDenied", name, err)
+		}
+	}
+	// the token itself still works, and so does the real session
+	if _, err := s.GetLoginAccount(&SessionOnlyParams{Session: token}); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.ExportAccount(&SessionOnlyParams{Session: session}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters, the defaults every authenticator app understands
+const totp_issuer = "XJTUTennis"
+const totp_period = 30
+const totp_digits = 6
+
+// accept codes from one period before and after, to allow for clock drift
+const totp_skew = 1
+
+const totp_recovery_codes = 10
+
+// time given to enter the code after the passwd has been accepted
+const totp_challenge_expiry = 5 * time.Minute
+
+var totp_encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTotpSecret() string {
+	rand_bytes := make([]byte, 20)
+	_, err := rand.Read(rand_bytes)
+	if err != nil {
+		panic(err)
+	}
+	return totp_encoding.EncodeToString(rand_bytes)
+}
+
+// RFC 4226 HOTP value of key at counter
+func hotp(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totp_digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totp_digits, value%modulo)
+}
+
+// returns the time step code matches, which has to be later than last_step
+// so that a code cannot be replayed.
+func verifyTotp(secret string, code string, last_step int64, now time.Time) (int64, bool) {
+	key, err := totp_encoding.DecodeString(secret)
+	if err != nil || len(code) != totp_digits {
+		return 0, false
+	}
+	current := now.Unix() / totp_period
+	for step := current - totp_skew; step <= current+totp_skew; step++ {
+		if step <= last_step {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func newRecoveryCode() string {
+	rand_bytes := make([]byte, 5)
+	_, err := rand.Read(rand_bytes)
+	if err != nil {
+		panic(err)
+	}
+	code := strings.ToLower(totp_encoding.EncodeToString(rand_bytes))
+	return code[:4] + "-" + code[4:]
+}
+
+// recovery codes are random enough that a plain hash is sufficient
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func totpEnabled(db queryRower, account int64) (bool, error) {
+	var enabled bool
+	err := db.QueryRowContext(context.Background(), "SELECT `enabled` FROM `totp` WHERE `account` = ?", account).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// check code as either a TOTP code or an unused recovery code, consuming it
+func (t *SessionManager) verifySecondFactor(tx *sql.Tx, account int64, code string) error {
+	ctx := context.Background()
+	var sealed_secret string
+	var last_step int64
+	err := tx.QueryRowContext(ctx, "SELECT `secret`, `last_step` FROM `totp` WHERE `account` = ? AND `enabled` = 1", account).Scan(&sealed_secret, &last_step)
+	if err == sql.ErrNoRows {
+		return TennisApiError{errorType: InvalidQuery, message: "TOTP not enabled"}
+	}
+	if err != nil {
+		return err
+	}
+	secret, err := t.secrets.Open(sealed_secret)
+	if err != nil {
+		return err
+	}
+	if step, ok := verifyTotp(secret, code, last_step, time.Now()); ok {
+		_, err = tx.ExecContext(ctx, "UPDATE `totp` SET `last_step` = ? WHERE `account` = ?", step, account)
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE `totp_recovery_codes` SET `used` = 1 WHERE `account` = ? AND `code_hash` = ? AND `used` = 0", account, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return TennisApiError{errorType: WrongTotpCode}
+	}
+	return nil
+}
+
+// a login whose passwd has been accepted, waiting for the TOTP code
+type pendingLogin struct {
+	Account   int64
+	User      string
+	Expiry    time.Time
+	ClientIp  string
+	UserAgent string
+}
+
+type TotpChallenge struct {
+	Challenge string
+}
+
+// issue a session for an authenticated account, or a challenge if the
+// account has TOTP enabled
+func (t *SessionManager) completeLogin(account *Account, client_ip string, user_agent string) (interface{}, error) {
+	enabled, err := totpEnabled(t.db, account.Uid)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return t.newSession(account.Uid, client_ip, user_agent)
+	}
+	now := time.Now()
+	// drop challenges nobody answered
+	t.pendingLogins.Range(func(key, value any) bool {
+		if now.After(value.(pendingLogin).Expiry) {
+			t.pendingLogins.Delete(key)
+		}
+		return true
+	})
+	rand_bytes := make([]byte, 32)
+	_, err = rand.Read(rand_bytes)
+	if err != nil {
+		return nil, err
+	}
+	challenge := base64.StdEncoding.EncodeToString(rand_bytes)
+	t.pendingLogins.Store(challenge, pendingLogin{
+		Account:   account.Uid,
+		User:      account.User,
+		Expiry:    now.Add(totp_challenge_expiry),
+		ClientIp:  client_ip,
+		UserAgent: user_agent,
+	})
+	return TotpChallenge{Challenge: challenge}, nil
+}
+
+type LoginTotpParams struct {
+	Challenge string
+	Code      string
+	ClientIp  string
+	UserAgent string
+}
+
+func (t *SessionManager) LoginTotp(params *LoginTotpParams) (SessionId, error) {
+	val, ok := t.pendingLogins.Load(params.Challenge)
+	if !ok || time.Now().After(val.(pendingLogin).Expiry) {
+		return "", TennisApiError{errorType: NotLoggedIn}
+	}
+	pending := val.(pendingLogin)
+	err := t.throttleLogin(pending.User, params.ClientIp, func() error {
+		return t.withTx(func(tx *sql.Tx) error {
+			return t.verifySecondFactor(tx, pending.Account, params.Code)
+		})
+	})
+	if err != nil {
+		t.audit(pending.Account, pending.Account, AuditLoginFailed, fmt.Sprintf("totp %s: %s", pending.User, err.Error()), params.ClientIp, params.UserAgent)
+		return "", err
+	}
+	t.pendingLogins.Delete(params.Challenge)
+	t.audit(pending.Account, pending.Account, AuditLogin, "passwd+totp", params.ClientIp, params.UserAgent)
+	return t.newSession(pending.Account, pending.ClientIp, pending.UserAgent)
+}
+
+type TotpStatus struct {
+	Enabled           bool
+	RecoveryCodesLeft int
+}
+
+func (t *SessionManager) GetTotpStatus(params *SessionOnlyParams) (TotpStatus, error) {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return TotpStatus{}, err
+	}
+	var status TotpStatus
+	status.Enabled, err = totpEnabled(t.db, account.Uid)
+	if err != nil {
+		return TotpStatus{}, err
+	}
+	err = t.db.QueryRowContext(context.Background(), "SELECT COUNT(`uid`) FROM `totp_recovery_codes` WHERE `account` = ? AND `used` = 0", account.Uid).Scan(&status.RecoveryCodesLeft)
+	if err != nil {
+		return TotpStatus{}, err
+	}
+	return status, nil
+}
+
+type TotpEnrollment struct {
+	Secret string
+	Uri    string
+}
+
+// start (or restart) an enrollment. TOTP is only required once the secret
+// is confirmed by ConfirmTotp.
+func (t *SessionManager) EnrollTotp(params *SessionOnlyParams) (TotpEnrollment, error) {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return TotpEnrollment{}, err
+	}
+	secret := newTotpSecret()
+	sealed, err := t.secrets.Seal(secret)
+	if err != nil {
+		return TotpEnrollment{}, err
+	}
+	err = t.withTx(func(tx *sql.Tx) error {
+		enabled, err := totpEnabled(tx, account.Uid)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return TennisApiError{errorType: InvalidQuery, message: "TOTP already enabled"}
+		}
+		_, err = tx.ExecContext(context.Background(), "INSERT INTO `totp` (`account`, `secret`) VALUES (?, ?) ON CONFLICT (`account`) DO UPDATE SET `secret` = excluded.`secret`, `last_step` = 0", account.Uid, sealed)
+		return err
+	})
+	if err != nil {
+		return TotpEnrollment{}, err
+	}
+	label := url.PathEscape(totp_issuer + ":" + account.User)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totp_issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totp_digits))
+	query.Set("period", fmt.Sprint(totp_period))
+	return TotpEnrollment{
+		Secret: secret,
+		Uri:    "otpauth://totp/" + label + "?" + query.Encode(),
+	}, nil
+}
+
+type ConfirmTotpParams struct {
+	Session SessionId
+	Code    string
+}
+
+// enable TOTP once the user proves their authenticator works. Returns the
+// recovery codes, which are never shown again.
+func (t *SessionManager) ConfirmTotp(params *ConfirmTotpParams) ([]string, error) {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, totp_recovery_codes)
+	err = t.withTx(func(tx *sql.Tx) error {
+		ctx := context.Background()
+		var sealed_secret string
+		var enabled bool
+		err := tx.QueryRowContext(ctx, "SELECT `secret`, `enabled` FROM `totp` WHERE `account` = ?", account.Uid).Scan(&sealed_secret, &enabled)
+		if err == sql.ErrNoRows {
+			return TennisApiError{errorType: InvalidQuery, message: "TOTP not enrolled"}
+		}
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return TennisApiError{errorType: InvalidQuery, message: "TOTP already enabled"}
+		}
+		secret, err := t.secrets.Open(sealed_secret)
+		if err != nil {
+			return err
+		}
+		step, ok := verifyTotp(secret, params.Code, 0, time.Now())
+		if !ok {
+			return TennisApiError{errorType: WrongTotpCode}
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE `totp` SET `enabled` = 1, `last_step` = ? WHERE `account` = ?", step, account.Uid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM `totp_recovery_codes` WHERE `account` = ?", account.Uid)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < totp_recovery_codes; i++ {
+			code := newRecoveryCode()
+			_, err = tx.ExecContext(ctx, "INSERT INTO `totp_recovery_codes` (`account`, `code_hash`) VALUES (?, ?)", account.Uid, hashRecoveryCode(code))
+			if err != nil {
+				return err
+			}
+			codes = append(codes, code)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+type DisableTotpParams struct {
+	Session   SessionId
+	Passwd    string
+	Code      string
+	ClientIp  string
+	UserAgent string
+}
+
+// disabling requires the passwd and a current code, so that a stolen session
+// alone cannot turn TOTP off
+func (t *SessionManager) DisableTotp(params *DisableTotpParams) error {
+	account, err := t.getInteractiveSession(params.Session)
+	if err != nil {
+		return err
+	}
+	return t.throttleLogin(account.User, params.ClientIp, func() error {
+		// bcrypt is slow, so it must not run while holding the write lock
+		if !verifyPasswd(account.Passwd, params.Passwd) {
+			return TennisApiError{errorType: WrongPasswd}
+		}
+		return t.withTx(func(tx *sql.Tx) error {
+			err := t.verifySecondFactor(tx, account.Uid, params.Code)
+			if err != nil {
+				return err
+			}
+			ctx := context.Background()
+			_, err = tx.ExecContext(ctx, "DELETE FROM `totp` WHERE `account` = ?", account.Uid)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "DELETE FROM `totp_recovery_codes` WHERE `account` = ?", account.Uid)
+			return err
+		})
+	})
+}
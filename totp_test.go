@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA-1. The reference values have 8 digits; ours are
+// their last 6.
+func TestTotpRfc6238Vectors(t *testing.T) {
+	secret := totp_encoding.EncodeToString([]byte("12345678901234567890"))
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range cases {
+		key, _ := totp_encoding.DecodeString(secret)
+		if code := hotp(key, tc.unix/totp_period); code != tc.code {
+			t.Errorf("hotp at %d: got %s, want %s", tc.unix, code, tc.code)
+		}
+		step, ok := verifyTotp(secret, tc.code, 0, time.Unix(tc.unix, 0))
+		if !ok || step != tc.unix/totp_period {
+			t.Errorf("verifyTotp at %d: got step %d, %v", tc.unix, step, ok)
+		}
+	}
+}
+
+func TestTotpVerify(t *testing.T) {
+	secret := totp_encoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totp_period
+	key, _ := totp_encoding.DecodeString(secret)
+	cases := []struct {
+		name      string
+		code      string
+		last_step int64
+		ok        bool
+	}{
+		{"current", hotp(key, current), 0, true},
+		{"previous period", hotp(key, current-1), 0, true},
+		{"next period", hotp(key, current+1), 0, true},
+		{"outside skew", hotp(key, current-2), 0, false},
+		{"replayed", hotp(key, current), current, false},
+		{"older than last use", hotp(key, current-1), current, false},
+		{"wrong code", "000000", 0, false},
+		{"too short", "12345", 0, false},
+	}
+	for _, tc := range cases {
+		_, ok := verifyTotp(secret, tc.code, tc.last_step, now)
+		if ok != tc.ok {
+			t.Errorf("%s: got %v, want %v", tc.name, ok, tc.ok)
+		}
+	}
+}